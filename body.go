@@ -0,0 +1,138 @@
+package extend_metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// timedBody wraps a request body, accumulating the time spent blocked in
+// Read and the number of bytes read. The body may still be read by another
+// goroutine (such as a proxy transport) after the handler returned, so the
+// counters are atomic.
+type timedBody struct {
+	io.ReadCloser
+	clock Clock
+
+	reads    atomic.Int64
+	bytes    atomic.Int64
+	duration atomic.Int64
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	start := b.clock.Now()
+	n, err := b.ReadCloser.Read(p)
+	b.duration.Add(int64(b.clock.Now().Sub(start)))
+	b.bytes.Add(int64(n))
+	b.reads.Add(1)
+	return n, err
+}
+
+// read tells whether the body has been read at all.
+func (b *timedBody) read() bool {
+	return b.reads.Load() > 0
+}
+
+func (b *timedBody) readDuration() time.Duration {
+	return time.Duration(b.duration.Load())
+}
+
+// rate returns the bytes read per second spent reading. There is none for
+// empty bodies, nor for bodies read without measurable blocking, whose
+// rate would be meaningless.
+func (b *timedBody) rate() (float64, bool) {
+	n, d := b.bytes.Load(), b.readDuration()
+	if n <= 0 || d <= 0 {
+		return 0, false
+	}
+	return float64(n) / d.Seconds(), true
+}
+
+// limitedBody wraps a request body limited by http.MaxBytesReader, noting
+// whether the limit was exceeded. Like Caddy's request_body handler it
+// turns the error into a 413 handler error.
+type limitedBody struct {
+	io.ReadCloser
+
+	exceeded atomic.Bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		b.exceeded.Store(true)
+		err = caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+	}
+	return n, err
+}
+
+// bodyLimitExceeded tells whether a body size limit rejected the request
+// body: the limit of body, if any, or one set further down the handler
+// chain, such as by the request_body handler, whose error was returned.
+func bodyLimitExceeded(body *limitedBody, err error) bool {
+	if body != nil && body.exceeded.Load() {
+		return true
+	}
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// flushCounter wraps a response writer, counting the flushes which reached
+// the underlying writer. Handlers flush through http.ResponseController,
+// which finds it by unwrapping the response recorder. Flushes the
+// underlying writer doesn't support are not counted.
+type flushCounter struct {
+	http.ResponseWriter
+
+	flushes atomic.Int64
+}
+
+func (f *flushCounter) FlushError() error {
+	err := http.NewResponseController(f.ResponseWriter).Flush()
+	if err == nil {
+		f.flushes.Add(1)
+	}
+	return err
+}
+
+func (f *flushCounter) Flush() {
+	_ = f.FlushError()
+}
+
+func (f *flushCounter) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// writeErrorRecorder wraps a response writer, remembering whether a write
+// to the client failed and the status code of the response.
+type writeErrorRecorder struct {
+	http.ResponseWriter
+
+	status atomic.Int64
+	failed atomic.Bool
+}
+
+func (w *writeErrorRecorder) WriteHeader(status int) {
+	if status >= 200 {
+		w.status.CompareAndSwap(0, int64(status))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *writeErrorRecorder) Write(p []byte) (int, error) {
+	w.status.CompareAndSwap(0, http.StatusOK)
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		w.failed.Store(true)
+	}
+	return n, err
+}
+
+func (w *writeErrorRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,19 @@
+package extend_metrics
+
+import "time"
+
+// Clock is the time source durations are measured with. Programs embedding
+// the handler may provide their own, for instance to make durations
+// deterministic in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock reads the system clock. The times it returns carry a
+// monotonic reading, so durations between them are immune to wall-clock
+// adjustments.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,66 @@
+package extend_metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// testClock is a Clock which only moves when advanced.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestClockDurations(t *testing.T) {
+	if c, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_clock_default
+	}`); err != nil {
+		t.Fatal(err)
+	} else if _, ok := c.clock.(systemClock); !ok {
+		t.Errorf("expected the system clock by default, got %T", c.clock)
+	}
+
+	clock := &testClock{now: time.Unix(0, 0)}
+	c := parseTestCaddyfile(t, `extend_metrics {
+		registry custom:test_clock
+	}`)
+	c.Clock = clock
+	if err := c.Provision(newTestContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Cleanup() })
+
+	serveTestRequest(c, "GET", "http://example.com/", caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		clock.advance(250 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		clock.advance(time.Second)
+		return nil
+	}))
+
+	samples := scrapeTestRegistry(t, "custom:test_clock")
+	for _, want := range []string{
+		`caddy_http_extend_request_duration_seconds_sum{code="200",host="example.com",method="GET"} 1.25`,
+		`caddy_http_extend_response_duration_seconds_sum{code="200",host="example.com",method="GET"} 0.25`,
+	} {
+		if !strings.Contains(samples, want) {
+			t.Errorf("expected %s, got:\n%s", want, samples)
+		}
+	}
+}
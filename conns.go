@@ -0,0 +1,117 @@
+package extend_metrics
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// connRequestsIdle is how long a connection may go without a request before
+// its counter is forgotten. It exceeds Caddy's default idle timeout of 5
+// minutes, after which idle connections are closed anyway.
+const connRequestsIdle = 10 * time.Minute
+
+// connRequests numbers the requests made on each connection. Neither Go nor
+// Caddy count them, and handlers aren't told when a connection closes, so
+// counters are keyed by the connection Caddy stores in the request context
+// and swept once the connection has been idle for connRequestsIdle.
+type connRequests struct {
+	clock Clock
+	conns sync.Map // net.Conn -> *connCounter
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type connCounter struct {
+	requests atomic.Int64
+	active   atomic.Int64
+	lastSeen atomic.Int64
+}
+
+func newConnRequests(clock Clock) *connRequests {
+	m := &connRequests{
+		clock: clock,
+		done:  make(chan struct{}),
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(connRequestsIdle)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.sweep()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+
+	return m
+}
+
+func (m *connRequests) sweep() {
+	cutoff := m.clock.Now().Add(-connRequestsIdle).UnixNano()
+	m.conns.Range(func(key, value any) bool {
+		if value.(*connCounter).lastSeen.Load() < cutoff {
+			m.conns.Delete(key)
+		}
+		return true
+	})
+}
+
+// counter returns the counter of the connection of r, or nil if the
+// connection isn't known.
+func (m *connRequests) counter(r *http.Request) *connCounter {
+	conn, ok := r.Context().Value(caddyhttp.ConnCtxKey).(net.Conn)
+	if !ok || conn == nil {
+		return nil
+	}
+	v, ok := m.conns.Load(conn)
+	if !ok {
+		v, _ = m.conns.LoadOrStore(conn, new(connCounter))
+	}
+	counter := v.(*connCounter)
+	counter.lastSeen.Store(m.clock.Now().UnixNano())
+	return counter
+}
+
+// next returns the number of r on its connection, starting at 1, or false
+// if the connection isn't known.
+func (m *connRequests) next(r *http.Request) (int64, bool) {
+	counter := m.counter(r)
+	if counter == nil {
+		return 0, false
+	}
+	return counter.requests.Add(1), true
+}
+
+// enterStream counts r among the streams in flight on its HTTP/2
+// connection, and returns how many are, r included, along with a func to
+// call once r is done. Caddy doesn't expose the streams of its HTTP/2
+// server to handlers, so only the requests going through this handler are
+// counted; false is returned for other protocols or unknown connections.
+func (m *connRequests) enterStream(r *http.Request) (int64, func(), bool) {
+	if r.ProtoMajor != 2 {
+		return 0, nil, false
+	}
+	counter := m.counter(r)
+	if counter == nil {
+		return 0, nil, false
+	}
+	return counter.active.Add(1), func() { counter.active.Add(-1) }, true
+}
+
+func (m *connRequests) stop() {
+	close(m.done)
+	m.wg.Wait()
+}
@@ -0,0 +1,106 @@
+package extend_metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	caddy.RegisterModule(adminDeleteSeries{})
+}
+
+// adminHandlers are the provisioned handlers with enable_admin set, whose
+// series the admin endpoint may delete.
+var adminHandlers = struct {
+	mu       sync.Mutex
+	handlers map[*CaddyMetrics]struct{}
+}{
+	handlers: make(map[*CaddyMetrics]struct{}),
+}
+
+// partialDeleter is implemented by the metric vectors.
+type partialDeleter interface {
+	DeletePartialMatch(labels prometheus.Labels) int
+}
+
+// deleteSeries deletes the series matching labels from the collectors of
+// the handlers with enable_admin set, and returns how many were deleted.
+// Handlers may share collectors, which are only visited once.
+func deleteSeries(labels prometheus.Labels) int {
+	adminHandlers.mu.Lock()
+	defer adminHandlers.mu.Unlock()
+
+	deleted := 0
+	seen := make(map[prometheus.Collector]struct{})
+	for c := range adminHandlers.handlers {
+		for _, collector := range c.metrics.collectors {
+			if _, ok := seen[collector]; ok {
+				continue
+			}
+			seen[collector] = struct{}{}
+			if d, ok := collector.(partialDeleter); ok {
+				deleted += d.DeletePartialMatch(labels)
+			}
+		}
+	}
+	return deleted
+}
+
+// adminDeleteSeries deletes series on the admin endpoint, at
+// `POST /extend_metrics/delete?<label>=<value>...`, such as to drop the
+// series of junk hosts without restarting Caddy. Only the series matching
+// all the given labels are deleted, from the handlers with enable_admin
+// set.
+type adminDeleteSeries struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminDeleteSeries) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.extend_metrics_delete",
+		New: func() caddy.Module { return new(adminDeleteSeries) },
+	}
+}
+
+// Routes returns the admin routes of series deletion.
+func (a *adminDeleteSeries) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{
+		Pattern: "/extend_metrics/delete",
+		Handler: caddy.AdminHandlerFunc(a.serveDelete),
+	}}
+}
+
+func (a *adminDeleteSeries) serveDelete(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+	query := r.URL.Query()
+	if len(query) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("at least one label to match is required"),
+		}
+	}
+	labels := make(prometheus.Labels, len(query))
+	for name, values := range query {
+		if len(values) != 1 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("label %s must be given exactly once", name),
+			}
+		}
+		labels[name] = values[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]int{"deleted": deleteSeries(labels)})
+}
+
+var _ caddy.AdminRouter = (*adminDeleteSeries)(nil)
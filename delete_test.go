@@ -0,0 +1,72 @@
+package extend_metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestDeleteSeries(t *testing.T) {
+	const adminSpec, otherSpec = "custom:test_delete_admin", "custom:test_delete_other"
+	admin, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_delete_admin
+		enable_admin
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_delete_other
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*CaddyMetrics{admin, other} {
+		serveTestRequest(c, "GET", "http://a.example.com/", okHandler)
+		serveTestRequest(c, "GET", "http://b.example.com/", okHandler)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/extend_metrics/delete?host=a.example.com", nil)
+	if err := new(adminDeleteSeries).serveDelete(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct{ Deleted int }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Deleted == 0 {
+		t.Errorf("expected deleted series to be reported, got %+v, %v", resp, err)
+	}
+
+	samples := scrapeTestRegistry(t, adminSpec)
+	if strings.Contains(samples, `host="a.example.com"`) {
+		t.Errorf("expected the series of a.example.com to be deleted, got:\n%s", samples)
+	}
+	if !strings.Contains(samples, `caddy_http_extend_requests_total{host="b.example.com"}`) {
+		t.Errorf("expected the series of b.example.com to be kept, got:\n%s", samples)
+	}
+	if samples := scrapeTestRegistry(t, otherSpec); !strings.Contains(samples, `caddy_http_extend_requests_total{host="a.example.com"}`) {
+		t.Errorf("expected the series of handlers without enable_admin to be kept, got:\n%s", samples)
+	}
+}
+
+func TestDeleteSeriesRejected(t *testing.T) {
+	for _, tt := range []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodGet, "/extend_metrics/delete?host=a.example.com", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/extend_metrics/delete", http.StatusBadRequest},
+		{http.MethodPost, "/extend_metrics/delete?host=a.example.com&host=b.example.com", http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		err := new(adminDeleteSeries).serveDelete(httptest.NewRecorder(), r)
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.status {
+			t.Errorf("%s %s: expected a %d, got %v", tt.method, tt.target, tt.status, err)
+		}
+	}
+}
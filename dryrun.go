@@ -0,0 +1,124 @@
+package extend_metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDryRunWindow = time.Minute
+	// dryRunMaxValues bounds the values remembered per label, and the label
+	// sets remembered, so that a dry run can't exhaust memory on exactly the
+	// cardinality explosion it is meant to reveal.
+	dryRunMaxValues = 10000
+)
+
+// dryRun counts the distinct label values the code-labeled metrics would be
+// observed with, logging a summary every window.
+type dryRun struct {
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	values map[string]map[string]struct{} // label name -> values
+	series map[string]struct{}
+	count  int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newDryRun(logger *zap.Logger, window time.Duration) *dryRun {
+	d := &dryRun{
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	d.reset()
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.report()
+			case <-d.done:
+				return
+			}
+		}
+	}()
+
+	return d
+}
+
+func (d *dryRun) reset() {
+	d.values = make(map[string]map[string]struct{})
+	d.series = make(map[string]struct{})
+	d.count = 0
+}
+
+func (d *dryRun) record(labels prometheus.Labels) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(labels[name])
+		key.WriteByte(0)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.count++
+	for name, value := range labels {
+		values, ok := d.values[name]
+		if !ok {
+			values = make(map[string]struct{})
+			d.values[name] = values
+		}
+		if len(values) < dryRunMaxValues {
+			values[value] = struct{}{}
+		}
+	}
+	if len(d.series) < dryRunMaxValues {
+		d.series[key.String()] = struct{}{}
+	}
+}
+
+func (d *dryRun) report() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fields := []zap.Field{
+		zap.Int("requests", d.count),
+		zap.Int("label_sets", len(d.series)),
+	}
+	names := make([]string, 0, len(d.values))
+	for name := range d.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, zap.Int("distinct_"+name, len(d.values[name])))
+	}
+	d.logger.Info("dry run label summary", fields...)
+
+	d.reset()
+}
+
+func (d *dryRun) stop() {
+	close(d.done)
+	d.wg.Wait()
+}
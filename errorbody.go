@@ -0,0 +1,139 @@
+package extend_metrics
+
+import (
+	"bytes"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultErrorBodyReadBytes  = 256
+	defaultErrorBodyMaxClasses = 100
+	defaultErrorBodyMaxBuffer  = 64 << 10
+)
+
+// ErrorBodyClass configures the classification of 5xx response bodies into
+// `error_body_class_total`. The start of each body is normalized (case,
+// whitespace and digits, so that IDs and timestamps don't matter) and
+// hashed into its class, and the normalized text of every new class is
+// logged so the hashes can be told apart.
+//
+// Classifying requires buffering the response in memory until the handler
+// chain returns, so only 5xx responses declaring a Content-Length of at
+// most the buffer limit are classified; the others are streamed as usual.
+type ErrorBodyClass struct {
+	// How many bytes of the body are classified. Default: 256.
+	ReadBytes int `json:"read_bytes,omitempty"`
+
+	// How many distinct classes are tracked; later ones are counted as
+	// `other`. Default: 100.
+	MaxClasses int `json:"max_classes,omitempty"`
+
+	// Largest Content-Length of a response which is buffered.
+	// Default: 64 KiB.
+	MaxBufferSize int `json:"max_buffer_size,omitempty"`
+}
+
+// errorBodyClassifier tracks the classes seen so far, up to the cap.
+type errorBodyClassifier struct {
+	readBytes  int
+	maxClasses int
+	maxBuffer  int
+	counter    *prometheus.CounterVec
+	hostKey    string
+	logger     *zap.Logger
+
+	classes *boundedSet
+}
+
+var errorBodyBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func newErrorBodyClassifier(cfg *ErrorBodyClass, counter *prometheus.CounterVec, hostKey string, logger *zap.Logger) *errorBodyClassifier {
+	e := &errorBodyClassifier{
+		readBytes:  cfg.ReadBytes,
+		maxClasses: cfg.MaxClasses,
+		maxBuffer:  cfg.MaxBufferSize,
+		counter:    counter,
+		hostKey:    hostKey,
+		logger:     logger,
+	}
+	if e.readBytes <= 0 {
+		e.readBytes = defaultErrorBodyReadBytes
+	}
+	if e.maxClasses <= 0 {
+		e.maxClasses = defaultErrorBodyMaxClasses
+	}
+	if e.maxBuffer <= 0 {
+		e.maxBuffer = defaultErrorBodyMaxBuffer
+	}
+	e.classes = newBoundedSet(e.maxClasses)
+	return e
+}
+
+// shouldBuffer tells whether a response is to be buffered for
+// classification.
+func (e *errorBodyClassifier) shouldBuffer(status int, header http.Header) bool {
+	if status < 500 || status > 599 {
+		return false
+	}
+	size, err := strconv.Atoi(header.Get("Content-Length"))
+	return err == nil && size > 0 && size <= e.maxBuffer
+}
+
+// observe counts the class of a buffered body.
+func (e *errorBodyClassifier) observe(host string, body []byte) {
+	if len(body) > e.readBytes {
+		body = body[:e.readBytes]
+	}
+	text := normalizeErrorBody(body)
+	if text == "" {
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(text))
+	class := strconv.FormatUint(uint64(h.Sum32()), 16)
+
+	switch ok, added := e.classes.admit(class); {
+	case !ok:
+		class = otherCode
+	case added:
+		e.logger.Info("new error body class", zap.String("class", class), zap.String("body", text))
+	}
+
+	e.counter.With(prometheus.Labels{e.hostKey: host, "class": class}).Inc()
+}
+
+// normalizeErrorBody lowercases the body, collapses runs of whitespace
+// into a space and runs of digits into a `#`.
+func normalizeErrorBody(body []byte) string {
+	var sb strings.Builder
+	var lastSpace, lastDigit bool
+	for _, r := range strings.ToValidUTF8(string(body), "") {
+		switch {
+		case unicode.IsSpace(r):
+			if !lastSpace && sb.Len() > 0 {
+				sb.WriteByte(' ')
+			}
+			lastSpace, lastDigit = true, false
+		case unicode.IsDigit(r):
+			if !lastDigit {
+				sb.WriteByte('#')
+			}
+			lastSpace, lastDigit = false, true
+		default:
+			sb.WriteRune(unicode.ToLower(r))
+			lastSpace, lastDigit = false, false
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
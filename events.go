@@ -0,0 +1,128 @@
+package extend_metrics
+
+import (
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	eventSlowRequest = "extend_metrics.slow_request"
+	eventError       = "extend_metrics.error"
+)
+
+// Events configures the events emitted to Caddy's events app, which other
+// modules can subscribe to. Their data holds the labels of the request,
+// plus `duration` (in seconds) for slow requests and `error` for errors.
+//
+// Events are emitted synchronously once the handler chain returns, so
+// slow subscribers delay the completion of the request. An event nobody
+// subscribed to in the events app config is never emitted; subscriptions
+// made programmatically with On aren't seen.
+type Events struct {
+	// Emits `extend_metrics.slow_request` for requests taking at least
+	// this long. Default: no slow request events.
+	SlowRequest caddy.Duration `json:"slow_request,omitempty"`
+
+	// Emits `extend_metrics.error` for requests whose handler chain
+	// returned an error.
+	Errors bool `json:"errors,omitempty"`
+}
+
+// eventEmitter emits the configured events which have subscribers.
+type eventEmitter struct {
+	ctx  caddy.Context
+	app  *caddyevents.App
+	slow time.Duration
+	errs bool
+}
+
+// newEventEmitter returns the emitter of the events of cfg, or nil when
+// none has subscribers. The events app is loaded by the HTTP app before its
+// handlers are provisioned, so it is only missing outside of a server.
+func newEventEmitter(ctx caddy.Context, cfg *Events) *eventEmitter {
+	app, ok := ctx.AppIfConfigured("events").(*caddyevents.App)
+	if !ok {
+		return nil
+	}
+	var origin caddy.ModuleID
+	if mod := ctx.Module(); mod != nil {
+		origin = mod.CaddyModule().ID
+	}
+	e := &eventEmitter{ctx: ctx, app: app}
+	if cfg.SlowRequest > 0 && subscribed(app, eventSlowRequest, origin) {
+		e.slow = time.Duration(cfg.SlowRequest)
+	}
+	e.errs = cfg.Errors && subscribed(app, eventError, origin)
+	if e.slow == 0 && !e.errs {
+		return nil
+	}
+	return e
+}
+
+// subscribed tells whether a subscription of app matches the event named
+// name emitted by the module origin, or any module within it.
+func subscribed(app *caddyevents.App, name string, origin caddy.ModuleID) bool {
+	for _, sub := range app.Subscriptions {
+		if matchEventName(sub.Events, name) && matchEventModule(sub.Modules, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchEventName(events []string, name string) bool {
+	if len(events) == 0 {
+		return true
+	}
+	for _, event := range events {
+		if event == "" || strings.EqualFold(event, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchEventModule(modules []caddy.ModuleID, origin caddy.ModuleID) bool {
+	if len(modules) == 0 {
+		return true
+	}
+	for _, mod := range modules {
+		if mod == "" || mod == origin || strings.HasPrefix(string(origin), string(mod)+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// eventData returns the data of an event about a request with labels.
+func eventData(labels prometheus.Labels) map[string]any {
+	data := make(map[string]any, len(labels)+1)
+	for name, value := range labels {
+		data[name] = value
+	}
+	return data
+}
+
+// requestDone emits a slow request event if the request took elapsed.
+func (e *eventEmitter) requestDone(labels prometheus.Labels, elapsed time.Duration) {
+	if e.slow == 0 || elapsed < e.slow {
+		return
+	}
+	data := eventData(labels)
+	data["duration"] = elapsed.Seconds()
+	e.app.Emit(e.ctx, eventSlowRequest, data)
+}
+
+// requestFailed emits an error event for the request with labels.
+func (e *eventEmitter) requestFailed(labels prometheus.Labels, err error) {
+	if !e.errs {
+		return
+	}
+	data := eventData(labels)
+	data["error"] = err.Error()
+	e.app.Emit(e.ctx, eventError, data)
+}
@@ -0,0 +1,112 @@
+package extend_metrics
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Exporter{})
+	httpcaddyfile.RegisterHandlerDirective("extend_metrics_exporter", parseExporterCaddyfile)
+}
+
+// Exporter serves the metrics of a single registry for scraping. Unlike
+// Caddy's own metrics handler it can serve a custom registry.
+type Exporter struct {
+	// The registry to serve, one of `default`, `caddy` or `custom:<name>`.
+	// Default: `default`.
+	Registry string `json:"registry,omitempty"`
+
+	// Disable OpenMetrics negotiation, enabled by default. Counters carry no
+	// `_created` series in either format: client_golang records their
+	// creation time, which the OTLP export uses as the start time, but the
+	// expfmt version this module builds against can't encode it.
+	DisableOpenMetrics bool `json:"disable_openmetrics,omitempty"`
+
+	handler http.Handler
+}
+
+// CaddyModule returns the Caddy module information.
+func (Exporter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.extend_metrics_exporter",
+		New: func() caddy.Module { return new(Exporter) },
+	}
+}
+
+type zapLogger struct {
+	zl *zap.Logger
+}
+
+func (l *zapLogger) Println(v ...any) {
+	l.zl.Sugar().Error(v...)
+}
+
+// Provision sets up the exporter.
+func (e *Exporter) Provision(ctx caddy.Context) error {
+	reg, err := resolveRegistry(e.Registry)
+	if err != nil {
+		return err
+	}
+
+	e.handler = newRegistryHandler(reg, ctx.Logger(), !e.DisableOpenMetrics)
+	return nil
+}
+
+// newRegistryHandler returns a handler serving the metrics of reg.
+func newRegistryHandler(reg *registryRef, logger *zap.Logger, enableOpenMetrics bool) http.Handler {
+	return promhttp.InstrumentMetricHandler(reg,
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+			ErrorLog:          &zapLogger{logger},
+			EnableOpenMetrics: enableOpenMetrics,
+		}),
+	)
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	e.handler.ServeHTTP(w, r)
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the exporter from Caddyfile tokens. Syntax:
+//
+//	extend_metrics_exporter [<registry>] {
+//		disable_openmetrics
+//	}
+func (e *Exporter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.NextArg()
+	if d.NextArg() {
+		e.Registry = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "disable_openmetrics":
+			e.DisableOpenMetrics = true
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+func parseExporterCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var exporter = new(Exporter)
+	err := exporter.UnmarshalCaddyfile(h.Dispenser)
+	return exporter, err
+}
+
+var (
+	_ caddy.Provisioner           = (*Exporter)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Exporter)(nil)
+	_ caddyfile.Unmarshaler       = (*Exporter)(nil)
+)
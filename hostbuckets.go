@@ -0,0 +1,122 @@
+package extend_metrics
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HostBuckets overrides the duration buckets of the hosts matching a
+// pattern.
+type HostBuckets struct {
+	// The host label values the buckets apply to, in which `*` matches any
+	// sequence of characters, such as `*.example.com`.
+	Host string `json:"host,omitempty"`
+
+	// Buckets of the duration histograms of these hosts, in seconds.
+	Buckets []float64 `json:"buckets,omitempty"`
+}
+
+// hostBucketsVec is a duration histogram whose buckets depend on the host.
+// A histogram vector has a single bucket layout, so it holds one vector
+// per override besides the default one, all exposed as one family: the
+// series of each host only carry the buckets of its override.
+type hostBucketsVec struct {
+	prometheus.ObserverVec
+
+	hostKey   string
+	hostIndex int
+	buckets   []float64
+	overrides []hostBucketsOverride
+}
+
+type hostBucketsOverride struct {
+	host    string
+	buckets []float64
+	vec     *prometheus.HistogramVec
+}
+
+func newHostBucketsVec(opts prometheus.HistogramOpts, labels []string, hostKey string, hostBuckets []HostBuckets) *hostBucketsVec {
+	v := &hostBucketsVec{
+		ObserverVec: prometheus.NewHistogramVec(opts, labels),
+		hostKey:     hostKey,
+		buckets:     opts.Buckets,
+	}
+	for i, name := range labels {
+		if name == hostKey {
+			v.hostIndex = i
+		}
+	}
+	for _, hb := range hostBuckets {
+		o := opts
+		o.Buckets = hb.Buckets
+		v.overrides = append(v.overrides, hostBucketsOverride{host: hb.Host, buckets: hb.Buckets, vec: prometheus.NewHistogramVec(o, labels)})
+	}
+	return v
+}
+
+// vecFor returns the vector the series of host belong to: the first
+// matching override, or the default one.
+func (v *hostBucketsVec) vecFor(host string) prometheus.ObserverVec {
+	for _, o := range v.overrides {
+		if matchHost([]string{o.host}, host) {
+			return o.vec
+		}
+	}
+	return v.ObserverVec
+}
+
+func (v *hostBucketsVec) GetMetricWith(labels prometheus.Labels) (prometheus.Observer, error) {
+	return v.vecFor(labels[v.hostKey]).GetMetricWith(labels)
+}
+
+func (v *hostBucketsVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Observer, error) {
+	if v.hostIndex >= len(lvs) {
+		return nil, fmt.Errorf("expected a %s label value, got %d label values", v.hostKey, len(lvs))
+	}
+	return v.vecFor(lvs[v.hostIndex]).GetMetricWithLabelValues(lvs...)
+}
+
+func (v *hostBucketsVec) With(labels prometheus.Labels) prometheus.Observer {
+	return v.vecFor(labels[v.hostKey]).With(labels)
+}
+
+func (v *hostBucketsVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	o, err := v.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+// CurryWith is not supported, as the overrides can't be curried along.
+func (v *hostBucketsVec) CurryWith(prometheus.Labels) (prometheus.ObserverVec, error) {
+	return nil, errors.New("currying histograms with host bucket overrides is not supported")
+}
+
+func (v *hostBucketsVec) MustCurryWith(labels prometheus.Labels) prometheus.ObserverVec {
+	vec, err := v.CurryWith(labels)
+	if err != nil {
+		panic(err)
+	}
+	return vec
+}
+
+// DeletePartialMatch deletes the series matching labels from every vector.
+func (v *hostBucketsVec) DeletePartialMatch(labels prometheus.Labels) int {
+	deleted := v.ObserverVec.(*prometheus.HistogramVec).DeletePartialMatch(labels)
+	for _, o := range v.overrides {
+		deleted += o.vec.DeletePartialMatch(labels)
+	}
+	return deleted
+}
+
+// Collect collects the series of every vector. They all share the desc of
+// the default one, which is the only one described.
+func (v *hostBucketsVec) Collect(ch chan<- prometheus.Metric) {
+	v.ObserverVec.Collect(ch)
+	for _, o := range v.overrides {
+		o.vec.Collect(ch)
+	}
+}
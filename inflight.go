@@ -0,0 +1,191 @@
+package extend_metrics
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultInFlightMaxWindow = 15 * time.Second
+
+// inFlightMax tracks the high-water mark of concurrent requests per host.
+// Every window the mark reached during that window is published to the
+// gauge and reset to the current concurrency, so brief spikes between two
+// scrapes are not lost as they are with the instantaneous gauge.
+type inFlightMax struct {
+	gauge   *prometheus.GaugeVec
+	hostKey string
+	hosts   sync.Map // host -> *hostInFlight
+
+	// Guarded by inFlightMaxes.mu.
+	refs   int
+	window time.Duration
+
+	windows chan time.Duration
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// inFlightMaxes shares a tracker between the instances reporting to the
+// same gauge, such as the handlers sharing a registry or the old and new
+// instances during a config reload. The mark is then that of their
+// combined concurrency, as requests_in_flight counts it, rather than that
+// of whichever instance published last.
+var inFlightMaxes = struct {
+	mu       sync.Mutex
+	trackers map[*prometheus.GaugeVec]*inFlightMax
+}{
+	trackers: make(map[*prometheus.GaugeVec]*inFlightMax),
+}
+
+// acquireInFlightMax returns the tracker of gauge and a func to call once
+// the instance is cleaned up, which stops the tracker when the last
+// instance sharing it is gone. When the instances sharing it have
+// different windows, the one acquired last wins, so that a reload changing
+// the window takes effect.
+func acquireInFlightMax(gauge *prometheus.GaugeVec, hostKey string, window time.Duration) (*inFlightMax, func()) {
+	inFlightMaxes.mu.Lock()
+	defer inFlightMaxes.mu.Unlock()
+
+	m, ok := inFlightMaxes.trackers[gauge]
+	if !ok {
+		m = newInFlightMax(gauge, hostKey, window)
+		inFlightMaxes.trackers[gauge] = m
+	} else if m.window != window {
+		m.window = window
+		m.windows <- window
+	}
+	m.refs++
+
+	var once sync.Once
+	return m, func() { once.Do(m.release) }
+}
+
+func (m *inFlightMax) release() {
+	inFlightMaxes.mu.Lock()
+	m.refs--
+	last := m.refs == 0
+	if last {
+		delete(inFlightMaxes.trackers, m.gauge)
+	}
+	inFlightMaxes.mu.Unlock()
+
+	if last {
+		m.stop()
+	}
+}
+
+type hostInFlight struct {
+	current atomic.Int64
+	max     atomic.Int64
+}
+
+func newInFlightMax(gauge *prometheus.GaugeVec, hostKey string, window time.Duration) *inFlightMax {
+	m := &inFlightMax{
+		gauge:   gauge,
+		hostKey: hostKey,
+		window:  window,
+		windows: make(chan time.Duration),
+		done:    make(chan struct{}),
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.publish()
+			case window := <-m.windows:
+				ticker.Reset(window)
+			case <-m.done:
+				return
+			}
+		}
+	}()
+
+	return m
+}
+
+func (m *inFlightMax) publish() {
+	m.hosts.Range(func(key, value any) bool {
+		h := value.(*hostInFlight)
+		max := h.max.Swap(h.current.Load())
+		m.gauge.With(prometheus.Labels{m.hostKey: key.(string)}).Set(float64(max))
+		return true
+	})
+}
+
+func (m *inFlightMax) inc(host string) *hostInFlight {
+	v, ok := m.hosts.Load(host)
+	if !ok {
+		v, _ = m.hosts.LoadOrStore(host, new(hostInFlight))
+	}
+	h := v.(*hostInFlight)
+
+	n := h.current.Add(1)
+	for {
+		max := h.max.Load()
+		if n <= max || h.max.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	return h
+}
+
+func (h *hostInFlight) dec() {
+	h.current.Add(-1)
+}
+
+func (m *inFlightMax) stop() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+// trackInFlight counts a request as in flight until the returned function
+// is called. Callers defer the call right away, as in
+// `defer c.trackInFlight(host)()`, so that it also runs on the early
+// returns and when the handler chain panics; every path through ServeHTTP
+// which increments the gauge does so this way.
+//
+// The gauges are resolved once, before the request goes down the chain,
+// so the decrement hits the same series even if a handler rewrites the
+// path.
+func (c *CaddyMetrics) trackInFlight(host string, r *http.Request) func() {
+	inFlight := c.metrics.requestInFlight.With(prometheus.Labels{c.hostKey: host})
+	inFlight.Inc()
+
+	var byPrefix prometheus.Gauge
+	if c.metrics.requestInFlightByPathPrefix != nil {
+		byPrefix = c.metrics.requestInFlightByPathPrefix.With(prometheus.Labels{
+			c.hostKey:     host,
+			"path_prefix": pathPrefix(r.URL.Path, c.InFlightPathPrefixes),
+		})
+		byPrefix.Inc()
+	}
+
+	if c.inFlightMax == nil && byPrefix == nil {
+		return inFlight.Dec
+	}
+
+	var h *hostInFlight
+	if c.inFlightMax != nil {
+		h = c.inFlightMax.inc(host)
+	}
+	return func() {
+		if h != nil {
+			h.dec()
+		}
+		if byPrefix != nil {
+			byPrefix.Dec()
+		}
+		inFlight.Dec()
+	}
+}
@@ -0,0 +1,181 @@
+package extend_metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInFlightBalanced(t *testing.T) {
+	c, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_in_flight_balanced
+		exclude_paths /skip
+		in_flight_path_prefixes /api
+		in_flight_max 1h
+		aborts
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const perKind = 50
+	release := make(chan struct{})
+	var entered sync.WaitGroup
+	block := func(http.ResponseWriter) {
+		entered.Done()
+		<-release
+	}
+	handlers := map[string]caddyhttp.Handler{
+		"/api/ok": caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			block(w)
+			return okHandler.ServeHTTP(w, r)
+		}),
+		"/api/error": caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			block(w)
+			return caddyhttp.Error(http.StatusBadGateway, errors.New("upstream down"))
+		}),
+		"/panic": caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			block(w)
+			panic("boom")
+		}),
+		"/abort": caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			block(w)
+			panic(http.ErrAbortHandler)
+		}),
+		"/skip": caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			block(w)
+			return nil
+		}),
+	}
+
+	var done sync.WaitGroup
+	for path, next := range handlers {
+		for i := 0; i < perKind; i++ {
+			entered.Add(1)
+			done.Add(1)
+			go func(path string, next caddyhttp.Handler) {
+				defer done.Done()
+				defer func() { recover() }()
+				serveTestRequest(c, "GET", "http://example.com"+path, next)
+			}(path, next)
+		}
+	}
+	entered.Wait()
+
+	inFlight := c.metrics.requestInFlight.WithLabelValues("example.com")
+	if got, want := testutil.ToFloat64(inFlight), float64(perKind*len(handlers)); got != want {
+		t.Errorf("expected %v requests in flight while blocked, got %v", want, got)
+	}
+	close(release)
+	done.Wait()
+
+	if got := testutil.ToFloat64(inFlight); got != 0 {
+		t.Errorf("expected requests_in_flight to return to 0, got %v", got)
+	}
+	for _, prefix := range []string{"/api", "other"} {
+		gauge := c.metrics.requestInFlightByPathPrefix.WithLabelValues("example.com", prefix)
+		if got := testutil.ToFloat64(gauge); got != 0 {
+			t.Errorf("expected requests_in_flight_by_path_prefix %s to return to 0, got %v", prefix, got)
+		}
+	}
+	if v, ok := c.inFlightMax.hosts.Load("example.com"); !ok {
+		t.Error("expected the in-flight max tracker to track example.com")
+	} else if got := v.(*hostInFlight).current.Load(); got != 0 {
+		t.Errorf("expected the in-flight max tracker to return to 0, got %d", got)
+	}
+}
+
+func TestInFlightMaxShared(t *testing.T) {
+	const input = `extend_metrics {
+		registry custom:test_in_flight_max_shared
+		in_flight_max 1h
+	}`
+	ctx := newTestContext(t)
+	a, err := provisionTestHandler(t, ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := provisionTestHandler(t, ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.inFlightMax != b.inFlightMax {
+		t.Fatal("expected the handlers sharing a registry to share the in-flight max tracker")
+	}
+
+	release := make(chan struct{})
+	var entered, done sync.WaitGroup
+	blocked := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		entered.Done()
+		<-release
+		return nil
+	})
+	for _, c := range []*CaddyMetrics{a, a, b} {
+		entered.Add(1)
+		done.Add(1)
+		go func(c *CaddyMetrics) {
+			defer done.Done()
+			serveTestRequest(c, "GET", "http://example.com/", blocked)
+		}(c)
+	}
+	entered.Wait()
+	close(release)
+	done.Wait()
+
+	a.inFlightMax.publish()
+	gauge := a.metrics.requestInFlightMax.WithLabelValues("example.com")
+	if got := testutil.ToFloat64(gauge); got != 3 {
+		t.Errorf("expected requests_in_flight_max to be 3 across both handlers, got %v", got)
+	}
+
+	a.Cleanup()
+	b.inFlightMax.publish()
+	if got := testutil.ToFloat64(gauge); got != 0 {
+		t.Errorf("expected the remaining handler to keep publishing, got %v", got)
+	}
+}
+
+func TestInFlightIncludesExcluded(t *testing.T) {
+	for _, include := range []bool{true, false} {
+		c, err := provisionTestHandler(t, newTestContext(t), fmt.Sprintf(`extend_metrics {
+			registry custom:test_in_flight_includes_excluded_%t
+			exclude_paths /skip
+			in_flight_includes_excluded %t
+		}`, include, include))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		release := make(chan struct{})
+		entered := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serveTestRequest(c, "GET", "http://example.com/skip", caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				close(entered)
+				<-release
+				return nil
+			}))
+		}()
+		<-entered
+
+		inFlight := c.metrics.requestInFlight.WithLabelValues("example.com")
+		want := 0.0
+		if include {
+			want = 1
+		}
+		if got := testutil.ToFloat64(inFlight); got != want {
+			t.Errorf("in_flight_includes_excluded %t: expected %v excluded requests in flight, got %v", include, want, got)
+		}
+		close(release)
+		<-done
+		if got := testutil.ToFloat64(inFlight); got != 0 {
+			t.Errorf("in_flight_includes_excluded %t: expected requests_in_flight to return to 0, got %v", include, got)
+		}
+	}
+}
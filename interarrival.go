@@ -0,0 +1,28 @@
+package extend_metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// interarrivals remembers when the last request to each host arrived. The
+// hosts are the values of the host label, which bounds the state kept.
+type interarrivals struct {
+	last sync.Map // host -> *atomic.Int64 of unix nanoseconds
+}
+
+// arrive records a request to host arriving at now and returns the time
+// since the previous one, or false for the first request to host.
+func (a *interarrivals) arrive(host string, now time.Time) (time.Duration, bool) {
+	v, ok := a.last.Load(host)
+	if !ok {
+		v, _ = a.last.LoadOrStore(host, new(atomic.Int64))
+	}
+	prev := v.(*atomic.Int64).Swap(now.UnixNano())
+	if prev == 0 {
+		return 0, false
+	}
+	// concurrent arrivals may swap in a slightly earlier time last
+	return max(time.Duration(now.UnixNano()-prev), 0), true
+}
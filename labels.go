@@ -0,0 +1,849 @@
+package extend_metrics
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of MethodLabels.
+const (
+	methodLabelsMethod = "method"
+	methodLabelsClass  = "method_class"
+	methodLabelsBoth   = "both"
+)
+
+// Values of LabelValueCase.
+const (
+	labelCasePreserve = "preserve"
+	labelCaseUpper    = "upper"
+	labelCaseLower    = "lower"
+)
+
+const defaultMethodOverrideHeader = "X-HTTP-Method-Override"
+
+// Values of the auth label.
+const (
+	authAuthenticated   = "authenticated"
+	authUnauthenticated = "unauthenticated"
+	authDenied          = "denied"
+	authNone            = "none"
+)
+
+// AuthLabel configures the optional `auth` label, classifying requests by
+// the outcome of authentication performed further down the handler chain.
+//
+// Caddy doesn't expose the outcome uniformly, so it is read from a source
+// set by the auth middleware. A value equal to one of `authenticated`,
+// `unauthenticated`, `denied` or `none` is used as is; any other non-empty
+// value (such as a user ID) means `authenticated`. Without a value the
+// status code decides: 401 is `unauthenticated`, 403 is `denied` and
+// anything else is `none`.
+type AuthLabel struct {
+	// Where the value is read from: `header` (a response header),
+	// `context` (a request context value stored under a caddy.CtxKey) or
+	// `placeholder` (a placeholder such as `http.auth.user.id`). Context
+	// values and placeholders are resolved synchronously, without a
+	// timeout, like the service label.
+	Source string `json:"source,omitempty"`
+
+	// The header name, context key or placeholder to read.
+	Name string `json:"name,omitempty"`
+}
+
+func (a *AuthLabel) validate() error {
+	switch a.Source {
+	case "header", "context", "placeholder":
+	default:
+		return fmt.Errorf("unrecognized auth_label source: %s", a.Source)
+	}
+	if a.Name == "" {
+		return fmt.Errorf("auth_label requires a name")
+	}
+	return nil
+}
+
+// classify returns the auth label value of a request.
+func (a *AuthLabel) classify(r *http.Request, header http.Header, status int) string {
+	var value string
+	switch a.Source {
+	case "header":
+		value = header.Get(a.Name)
+	case "context":
+		if v := r.Context().Value(caddy.CtxKey(a.Name)); v != nil {
+			value = fmt.Sprint(v)
+		}
+	case "placeholder":
+		if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			value, _ = repl.GetString(a.Name)
+		}
+	}
+
+	switch value {
+	case authAuthenticated, authUnauthenticated, authDenied, authNone:
+		return value
+	case "":
+	default:
+		return authAuthenticated
+	}
+
+	switch status {
+	case http.StatusUnauthorized:
+		return authUnauthenticated
+	case http.StatusForbidden:
+		return authDenied
+	default:
+		return authNone
+	}
+}
+
+// effectiveMethod returns the sanitized method a POST request tunnels
+// through the override header, or else the request's own method.
+func effectiveMethod(r *http.Request, header string) string {
+	if r.Method == http.MethodPost {
+		if override := r.Header.Get(header); override != "" {
+			return SanitizeMethod(override)
+		}
+	}
+	return SanitizeMethod(r.Method)
+}
+
+// methodCase applies label_value_case to a sanitized method.
+func (c *CaddyMetrics) methodCase(method string) string {
+	switch c.LabelValueCase {
+	case labelCaseUpper:
+		return strings.ToUpper(method)
+	case labelCaseLower:
+		return strings.ToLower(method)
+	}
+	return method
+}
+
+// hostSNIMatch tells whether the TLS server name of r matches its host, as
+// `true` or `false`, or `n/a` for plaintext requests and clients which
+// sent no server name.
+func hostSNIMatch(r *http.Request) string {
+	if r.TLS == nil || r.TLS.ServerName == "" {
+		return "n/a"
+	}
+	if strings.EqualFold(normalizeHost(r.Host), normalizeHost(r.TLS.ServerName)) {
+		return "true"
+	}
+	return "false"
+}
+
+// authorityHostMatch tells whether the `:authority` pseudo-header of an
+// HTTP/2 or HTTP/3 request matches its `Host` header. Go stores the former
+// in r.Host and leaves the latter in the headers; HTTP/1 requests only have
+// a Host header, which Go moves to r.Host, so they can't disagree.
+func authorityHostMatch(r *http.Request) string {
+	hosts := r.Header.Values("Host")
+	if r.ProtoMajor < 2 || len(hosts) == 0 {
+		return "n/a"
+	}
+	for _, host := range hosts {
+		if !strings.EqualFold(host, r.Host) {
+			return "false"
+		}
+	}
+	return "true"
+}
+
+// origin tells whether the client of r is `internal` or `external`. The
+// client IP set by Caddy takes trusted proxies into account; the remote
+// address is the fallback when it is missing.
+func (c *CaddyMetrics) origin(r *http.Request) string {
+	client, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if client == "" {
+		client = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+	if addr, err := netip.ParseAddr(client); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range c.internalNets {
+			if prefix.Contains(addr) {
+				return "internal"
+			}
+		}
+	}
+	return "external"
+}
+
+// transport returns the transport r arrived over, from the network of its
+// connection if known, or else from its protocol version.
+func transport(r *http.Request) string {
+	if conn, ok := r.Context().Value(caddyhttp.ConnCtxKey).(net.Conn); ok {
+		switch conn.LocalAddr().Network() {
+		case "tcp", "tcp4", "tcp6":
+			return "tcp"
+		case "udp", "udp4", "udp6":
+			return "quic"
+		default:
+			return "unknown"
+		}
+	}
+	switch r.ProtoMajor {
+	case 1, 2:
+		return "tcp"
+	case 3:
+		return "quic"
+	}
+	return "unknown"
+}
+
+// acceptEncoding collapses the Accept-Encoding header of r to the single
+// compressed encoding it accepts among `br`, `gzip` and `zstd`, `multiple`
+// when it accepts several, `other` when it accepts none of them but others
+// (such as `deflate` or `*`), `identity` when it accepts no compression and
+// `none` when it is missing. Encodings with a quality of 0 are refused, so
+// they don't count.
+func acceptEncoding(r *http.Request) string {
+	header := strings.ToLower(strings.Join(r.Header.Values("Accept-Encoding"), ","))
+	if strings.TrimSpace(header) == "" {
+		return "none"
+	}
+	found := "identity"
+	for _, token := range strings.Split(header, ",") {
+		encoding, params, _ := strings.Cut(token, ";")
+		encoding = strings.TrimSpace(encoding)
+		if encoding == "" || encoding == "identity" || refusedEncoding(params) {
+			continue
+		}
+		switch encoding {
+		case "br", "gzip", "zstd":
+		default:
+			encoding = otherCode
+		}
+		switch found {
+		case "identity", otherCode:
+			found = encoding
+		case encoding:
+		default:
+			if encoding != otherCode {
+				return "multiple"
+			}
+		}
+	}
+	return found
+}
+
+// refusedEncoding tells whether the params of an Accept-Encoding token
+// give it a quality of 0.
+func refusedEncoding(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.TrimSpace(name) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return err == nil && q == 0
+	}
+	return false
+}
+
+// alpn returns the protocol negotiated with ALPN for the connection of r:
+// `h2`, `http/1.1`, `h3` or `other`, or `none` for plaintext requests and
+// clients which negotiated none.
+func alpn(r *http.Request) string {
+	if r.TLS == nil || r.TLS.NegotiatedProtocol == "" {
+		return "none"
+	}
+	switch proto := r.TLS.NegotiatedProtocol; proto {
+	case "h2", "http/1.1", "h3":
+		return proto
+	}
+	return "other"
+}
+
+// hasBody tells whether r comes with a body, from its declared length or
+// chunked encoding, without reading it.
+func hasBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	return r.ContentLength != 0 || slices.Contains(r.TransferEncoding, "chunked")
+}
+
+// normalizeHost strips the port and any trailing dot from a host.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// cookieLabelName returns the name of the label telling whether requests
+// carry the named cookie: `cookie_` followed by the cookie name, in which
+// characters not allowed in label names are replaced with underscores.
+func cookieLabelName(cookie string) string {
+	return "cookie_" + strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, cookie)
+}
+
+// boundedSet remembers up to max distinct values.
+type boundedSet struct {
+	max int
+
+	mu     sync.Mutex
+	values map[string]struct{}
+}
+
+func newBoundedSet(max int) *boundedSet {
+	return &boundedSet{max: max, values: make(map[string]struct{})}
+}
+
+// admit tells whether v is, or now becomes, one of the remembered values,
+// and whether it was added by this call.
+func (s *boundedSet) admit(v string) (ok, added bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.values[v]; ok {
+		return true, false
+	}
+	if len(s.values) >= s.max {
+		return false, false
+	}
+	s.values[v] = struct{}{}
+	return true, true
+}
+
+const defaultServiceLabelMaxValues = 100
+
+// serviceLabel resolves the service label template for r. Values beyond
+// the cap of distinct values are reported as `other`.
+func (c *CaddyMetrics) serviceLabel(r *http.Request) string {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return otherCode
+	}
+	value := c.labelValue(repl.ReplaceAll(c.ServiceLabel, ""))
+	if value == "" && c.ServiceLabelDefault != "" {
+		return c.ServiceLabelDefault
+	}
+	if ok, _ := c.services.admit(value); !ok {
+		return otherCode
+	}
+	return value
+}
+
+const (
+	defaultPathLabelDepth     = 2
+	defaultPathLabelMaxValues = 100
+)
+
+// PathLabel configures a label holding a normalized request path.
+type PathLabel struct {
+	// How many leading path segments are kept, so that `/api/v1/users/42`
+	// becomes `/api/v1`. Default: 2.
+	Depth int `json:"depth,omitempty"`
+
+	// How many distinct values the label may take; later ones are
+	// reported as `other`. Default: 100.
+	MaxValues int `json:"max_values,omitempty"`
+
+	values *boundedSet
+}
+
+func (p *PathLabel) provision() {
+	if p.Depth <= 0 {
+		p.Depth = defaultPathLabelDepth
+	}
+	if p.MaxValues <= 0 {
+		p.MaxValues = defaultPathLabelMaxValues
+	}
+	p.values = newBoundedSet(p.MaxValues)
+}
+
+// value returns the label value of a path.
+func (p *PathLabel) value(c *CaddyMetrics, urlPath string) string {
+	value := c.labelValue(truncatePath(urlPath, p.Depth))
+	if ok, _ := p.values.admit(value); !ok {
+		return otherCode
+	}
+	return value
+}
+
+// truncatePath keeps the first depth segments of a path.
+func truncatePath(urlPath string, depth int) string {
+	segments := 0
+	for i := 1; i < len(urlPath); i++ {
+		if urlPath[i] == '/' {
+			segments++
+			if segments == depth {
+				return urlPath[:i]
+			}
+		}
+	}
+	if urlPath == "" {
+		return "/"
+	}
+	return urlPath
+}
+
+// origPath returns the path of r as the client sent it, before any
+// rewrite by the handlers upstream of this one.
+func origPath(r *http.Request) string {
+	if orig, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok && orig.URL != nil {
+		return orig.URL.Path
+	}
+	return r.URL.Path
+}
+
+const defaultVarLabelMaxValues = 100
+
+// VarLabel adds a label holding the value of a request variable.
+type VarLabel struct {
+	// The name of the label.
+	Label string `json:"label,omitempty"`
+
+	// The name of the variable, as in the `{http.vars.<name>}` placeholder.
+	Var string `json:"var,omitempty"`
+
+	// How many distinct values the label may take; later ones are
+	// reported as `other`. Default: 100.
+	MaxValues int `json:"max_values,omitempty"`
+
+	// The value of the label when the variable is unset or empty.
+	// Default: empty.
+	Default string `json:"default,omitempty"`
+
+	values *boundedSet
+}
+
+// varLabel returns the value of the variable of v for r, or the default
+// when the variable is unset or empty. Values beyond the cap of distinct
+// values are reported as `other`.
+func (c *CaddyMetrics) varLabel(r *http.Request, v *VarLabel) string {
+	var value string
+	switch val := caddyhttp.GetVar(r.Context(), v.Var).(type) {
+	case nil:
+	case string:
+		value = val
+	default:
+		value = fmt.Sprint(val)
+	}
+	value = c.labelValue(value)
+	if value == "" {
+		return v.Default
+	}
+	if ok, _ := v.values.admit(value); !ok {
+		return otherCode
+	}
+	return value
+}
+
+// certIssuer maps the issuer common name of the certificate served to r to
+// its configured label value, or `other` when it isn't configured. The
+// certificate must be stored under ServingCertificateCtxKey; without it
+// TLS requests are labeled `unknown`. Plaintext requests are `none`.
+func (c *CaddyMetrics) certIssuer(r *http.Request) string {
+	if r.TLS == nil {
+		return "none"
+	}
+	cert, ok := r.Context().Value(ServingCertificateCtxKey).(*x509.Certificate)
+	if !ok {
+		return "unknown"
+	}
+	if v, ok := c.CertIssuers[cert.Issuer.CommonName]; ok {
+		return v
+	}
+	return otherCode
+}
+
+// sizeClassNames name the classes delimited by the size class thresholds.
+var sizeClassNames = [...]string{"tiny", "small", "medium", "large", "huge"}
+
+// defaultSizeClasses are the upper bounds of the tiny, small, medium and
+// large size classes: 1 KiB, 16 KiB, 256 KiB and 4 MiB.
+var defaultSizeClasses = []int64{1 << 10, 16 << 10, 256 << 10, 4 << 20}
+
+// sizeClass returns the class of a response of the given size. Sizes below
+// the first threshold are tiny, and so on; sizes from the last threshold up
+// are huge.
+func sizeClass(size int64, thresholds []int64) string {
+	for i, threshold := range thresholds {
+		if size < threshold {
+			return sizeClassNames[i]
+		}
+	}
+	return sizeClassNames[len(sizeClassNames)-1]
+}
+
+// pathPrefix returns the longest of the prefixes the path starts with, or
+// `other`.
+func pathPrefix(p string, prefixes []string) string {
+	match := ""
+	for _, prefix := range prefixes {
+		if len(prefix) > len(match) && strings.HasPrefix(p, prefix) {
+			match = prefix
+		}
+	}
+	if match == "" {
+		return otherCode
+	}
+	return match
+}
+
+// labelValue prepares a value taken from the request for use as a label.
+func (c *CaddyMetrics) labelValue(v string) string {
+	return TruncateLabelValue(v, c.MaxLabelLength)
+}
+
+// Values of OtherHosts.
+const (
+	otherHostsCollapse = "collapse"
+	otherHostsSkip     = "skip"
+)
+
+const otherHost = "other"
+
+// Values of InvalidHostHandling.
+const (
+	invalidHostsBucket      = "bucket"
+	invalidHostsSanitize    = "sanitize"
+	invalidHostsPassthrough = "passthrough"
+)
+
+const (
+	invalidHost = "invalid"
+
+	// maxHostLength is the longest valid host, a domain name of 253
+	// characters and a port.
+	maxHostLength = 253 + len(":65535")
+)
+
+// validHostByte tells whether b may appear in a host, including the
+// brackets and colons of IPv6 addresses and ports.
+func validHostByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' ||
+		b == '.' || b == '-' || b == '_' || b == ':' || b == '[' || b == ']'
+}
+
+// checkHost applies invalid_host_handling to a host: hosts which are too
+// long or hold characters no host has, such as control characters, are
+// reported as `invalid`, or stripped from those characters and truncated.
+func (c *CaddyMetrics) checkHost(host string) string {
+	if c.InvalidHostHandling == invalidHostsPassthrough {
+		return host
+	}
+	valid := len(host) <= maxHostLength
+	for i := 0; valid && i < len(host); i++ {
+		valid = validHostByte(host[i])
+	}
+	if valid {
+		return host
+	}
+	if c.InvalidHostHandling != invalidHostsSanitize {
+		return invalidHost
+	}
+	sanitized := make([]byte, 0, min(len(host), maxHostLength))
+	for i := 0; i < len(host) && len(sanitized) < maxHostLength; i++ {
+		if validHostByte(host[i]) {
+			sanitized = append(sanitized, host[i])
+		}
+	}
+	if len(sanitized) == 0 {
+		return invalidHost
+	}
+	return string(sanitized)
+}
+
+// hostAllowed tells whether the host of r passes the host allowlist and
+// blocklist.
+func (c *CaddyMetrics) hostAllowed(r *http.Request) bool {
+	if len(c.HostAllowlist) == 0 && len(c.HostBlocklist) == 0 {
+		return true
+	}
+	host := strings.ToLower(normalizeHost(r.Host))
+	if len(c.HostAllowlist) > 0 && !matchHost(c.HostAllowlist, host) {
+		return false
+	}
+	return !matchHost(c.HostBlocklist, host)
+}
+
+// matchHost tells whether host matches one of patterns, in which `*`
+// matches any sequence of characters, such as `*.example.com`.
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HostGroup rewrites the host label of the hosts matching a regular
+// expression, such as to collapse per-tenant subdomains into one series.
+type HostGroup struct {
+	// The regular expression hosts are matched against. The host includes
+	// the port, if the request carried one.
+	Pattern string `json:"pattern,omitempty"`
+
+	// The replacement of the matched part of the host, which may refer to
+	// capture groups as in regexp.Regexp.ReplaceAllString.
+	Replacement string `json:"replacement,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (g *HostGroup) compile() error {
+	re, err := regexp.Compile(g.Pattern)
+	if err != nil {
+		return fmt.Errorf("compiling host_group pattern %s: %v", g.Pattern, err)
+	}
+	g.re = re
+	return nil
+}
+
+// hostLabel returns the host label value of r. Hosts left out by the host
+// allowlist or blocklist are reported as `other`. Otherwise the first
+// matching host group rewrites the host; hosts matching none are kept as
+// is unless a fallback value is configured.
+func (c *CaddyMetrics) hostLabel(r *http.Request) string {
+	if !c.hostAllowed(r) {
+		return otherHost
+	}
+	host := c.checkHost(r.Host)
+	if len(c.HostGroups) > 0 {
+		grouped := false
+		for _, g := range c.HostGroups {
+			if g.re.MatchString(host) {
+				host = g.re.ReplaceAllString(host, g.Replacement)
+				grouped = true
+				break
+			}
+		}
+		if !grouped && c.HostGroupFallback != "" {
+			host = c.HostGroupFallback
+		}
+	}
+	return c.labelValue(host)
+}
+
+// Default names of the renamable labels.
+const (
+	defaultHostLabelName   = "host"
+	defaultCodeLabelName   = "code"
+	defaultMethodLabelName = "method"
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabelNames can't be taken by the configurable labels: `le` and
+// `quantile` are reserved by Prometheus for histograms and summaries, and
+// the others are the fixed labels of the metrics in metrics.go, which a
+// configurable label sharing a vector with them would collide with. The
+// registry doesn't catch either at provisioning: the first is only checked
+// once a series is created, and the collectors are registered unchecked.
+var reservedLabelNames = map[string]struct{}{
+	"le":            {},
+	"quantile":      {},
+	"path_prefix":   {},
+	"name":          {},
+	"caddy_version": {},
+	"hash":          {},
+	"reason":        {},
+	"grpc_status":   {},
+	"header":        {},
+	"class":         {},
+	"metric":        {},
+}
+
+// validateLabelName checks name against the Prometheus label name rules.
+// Names starting with `__` are reserved for internal use.
+func validateLabelName(name string) error {
+	if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name: %s", name)
+	}
+	return nil
+}
+
+// setLabelNames resolves and validates the configured label names.
+func (c *CaddyMetrics) setLabelNames() error {
+	c.hostKey, c.codeKey, c.methodKey = defaultHostLabelName, defaultCodeLabelName, defaultMethodLabelName
+	if c.HostLabelName != "" {
+		c.hostKey = c.HostLabelName
+	}
+	if c.CodeLabelName != "" {
+		c.codeKey = c.CodeLabelName
+	}
+	if c.MethodLabelName != "" {
+		c.methodKey = c.MethodLabelName
+	}
+
+	seen := make(map[string]struct{})
+	for _, name := range append(c.httpLabelNames(), c.completionLabelNames()...) {
+		if err := validateLabelName(name); err != nil {
+			return err
+		}
+		if _, ok := reservedLabelNames[name]; ok {
+			return fmt.Errorf("reserved label name: %s", name)
+		}
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("duplicate label name: %s", name)
+		}
+		seen[name] = struct{}{}
+	}
+	return nil
+}
+
+// httpLabelNames returns the label names of the code-labeled metrics,
+// including the optional labels enabled in the config.
+func (c *CaddyMetrics) httpLabelNames() []string {
+	names := []string{c.hostKey, c.codeKey}
+	if c.MethodLabels != methodLabelsClass {
+		names = append(names, c.methodKey)
+	}
+	if c.MethodLabels == methodLabelsClass || c.MethodLabels == methodLabelsBoth {
+		names = append(names, "method_class")
+	}
+	if c.EffectiveMethodHeader != "" {
+		names = append(names, "effective_method")
+	}
+	if c.HostSNIMatchLabel {
+		names = append(names, "host_sni_match")
+	}
+	if c.AuthorityHostMatchLabel {
+		names = append(names, "authority_host_match")
+	}
+	if len(c.InternalCIDRs) > 0 {
+		names = append(names, "origin")
+	}
+	if c.TransportLabel {
+		names = append(names, "transport")
+	}
+	if c.AcceptEncodingLabel {
+		names = append(names, "accept_encoding")
+	}
+	if c.HasBodyLabel {
+		names = append(names, "has_body")
+	}
+	if c.ALPNLabel {
+		names = append(names, "alpn")
+	}
+	for _, name := range c.CookiePresenceLabels {
+		names = append(names, cookieLabelName(name))
+	}
+	if c.ServiceLabel != "" {
+		names = append(names, "service")
+	}
+	if c.RouteID != "" {
+		names = append(names, "route_id")
+	}
+	if c.PathLabel != nil {
+		names = append(names, "path")
+	}
+	if c.OrigPathLabel != nil {
+		names = append(names, "orig_path")
+	}
+	for _, v := range c.VarLabels {
+		names = append(names, v.Label)
+	}
+	if len(c.CertIssuers) > 0 {
+		names = append(names, "cert_issuer")
+	}
+	if c.AuthLabel != nil {
+		names = append(names, "auth")
+	}
+	return names
+}
+
+// completionLabelNames returns the names of the optional labels which are
+// only known once the response is complete.
+func (c *CaddyMetrics) completionLabelNames() []string {
+	var names []string
+	if len(c.SizeClasses) > 0 {
+		names = append(names, "size_class")
+	}
+	return names
+}
+
+// requestLabels returns the code-labeled metrics' labels which are known
+// before the request is handled.
+func (c *CaddyMetrics) requestLabels(host string, r *http.Request) prometheus.Labels {
+	method := SanitizeMethod(r.Method)
+	// the "code" value is set later, but initialized here to eliminate the possibility
+	// of a panic
+	labels := prometheus.Labels{c.hostKey: host, c.codeKey: ""}
+	if c.MethodLabels != methodLabelsClass {
+		labels[c.methodKey] = c.methodCase(method)
+	}
+	if c.MethodLabels == methodLabelsClass || c.MethodLabels == methodLabelsBoth {
+		labels["method_class"] = MethodClass(method)
+	}
+	if c.EffectiveMethodHeader != "" {
+		labels["effective_method"] = c.methodCase(effectiveMethod(r, c.EffectiveMethodHeader))
+	}
+	if c.HostSNIMatchLabel {
+		labels["host_sni_match"] = hostSNIMatch(r)
+	}
+	if c.AuthorityHostMatchLabel {
+		labels["authority_host_match"] = authorityHostMatch(r)
+	}
+	if len(c.InternalCIDRs) > 0 {
+		labels["origin"] = c.origin(r)
+	}
+	if c.TransportLabel {
+		labels["transport"] = transport(r)
+	}
+	if c.AcceptEncodingLabel {
+		labels["accept_encoding"] = acceptEncoding(r)
+	}
+	if c.HasBodyLabel {
+		labels["has_body"] = strconv.FormatBool(hasBody(r))
+	}
+	if c.ALPNLabel {
+		labels["alpn"] = alpn(r)
+	}
+	for _, name := range c.CookiePresenceLabels {
+		_, err := r.Cookie(name)
+		labels[cookieLabelName(name)] = strconv.FormatBool(err == nil)
+	}
+	if c.ServiceLabel != "" {
+		labels["service"] = c.serviceLabel(r)
+	}
+	if c.RouteID != "" {
+		labels["route_id"] = c.RouteID
+	}
+	if c.PathLabel != nil {
+		labels["path"] = c.PathLabel.value(c, r.URL.Path)
+	}
+	if c.OrigPathLabel != nil {
+		labels["orig_path"] = c.OrigPathLabel.value(c, origPath(r))
+	}
+	if len(c.CertIssuers) > 0 {
+		labels["cert_issuer"] = c.certIssuer(r)
+	}
+	return labels
+}
+
+// setResponseLabels fills in the labels which depend on the response.
+func (c *CaddyMetrics) setResponseLabels(labels map[string]string, r *http.Request, header http.Header, status int) {
+	// variables are read late so that handlers downstream of this one may
+	// set them too
+	for _, v := range c.VarLabels {
+		labels[v.Label] = c.varLabel(r, v)
+	}
+	if c.AuthLabel != nil {
+		labels["auth"] = c.AuthLabel.classify(r, header, status)
+	}
+}
@@ -0,0 +1,121 @@
+package extend_metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckHost(t *testing.T) {
+	long := strings.Repeat("a", maxHostLength+10)
+	for _, tt := range []struct {
+		host                          string
+		bucket, sanitize, passthrough string
+	}{
+		{
+			host:        "example.com",
+			bucket:      "example.com",
+			sanitize:    "example.com",
+			passthrough: "example.com",
+		},
+		{
+			host:        "[::1]:8443",
+			bucket:      "[::1]:8443",
+			sanitize:    "[::1]:8443",
+			passthrough: "[::1]:8443",
+		},
+		{
+			host:        "exa\x00mple.com\r\n",
+			bucket:      invalidHost,
+			sanitize:    "example.com",
+			passthrough: "exa\x00mple.com\r\n",
+		},
+		{
+			host:        "bad host/<script>",
+			bucket:      invalidHost,
+			sanitize:    "badhostscript",
+			passthrough: "bad host/<script>",
+		},
+		{
+			host:        long,
+			bucket:      invalidHost,
+			sanitize:    long[:maxHostLength],
+			passthrough: long,
+		},
+		{
+			host:        " \x01/\x7f",
+			bucket:      invalidHost,
+			sanitize:    invalidHost,
+			passthrough: " \x01/\x7f",
+		},
+	} {
+		for mode, want := range map[string]string{
+			"":                      tt.bucket,
+			invalidHostsBucket:      tt.bucket,
+			invalidHostsSanitize:    tt.sanitize,
+			invalidHostsPassthrough: tt.passthrough,
+		} {
+			c := &CaddyMetrics{InvalidHostHandling: mode}
+			if got := c.checkHost(tt.host); got != want {
+				t.Errorf("%s %q: expected %q, got %q", mode, tt.host, want, got)
+			}
+		}
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                          "none",
+		"gzip":                      "gzip",
+		"GZIP;q=0.8":                "gzip",
+		"gzip, deflate":             "gzip",
+		"gzip, deflate, br":         "multiple",
+		"br;q=1.0, zstd;q=0.5":      "multiple",
+		"gzip, br;q=0":              "gzip",
+		"br; q=0.0":                 "identity",
+		"identity":                  "identity",
+		"deflate":                   "other",
+		"*":                         "other",
+		"compress, deflate;q=0.5":   "other",
+		"*;q=0, identity":           "identity",
+		"gzip;q=0, deflate, zstd;q": "zstd",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		if got := acceptEncoding(r); got != want {
+			t.Errorf("%q: expected %q, got %q", header, want, got)
+		}
+	}
+}
+
+func TestReservedLabelNames(t *testing.T) {
+	for _, directive := range []string{
+		"code_label_name le",
+		"method_label_name quantile",
+		"host_label_name reason\n\t\texclude_paths /skip",
+		"host_label_name header",
+		"host_label_name grpc_status",
+		"host_label_name class",
+		"host_label_name path_prefix",
+		"code_label_name metric",
+		"method_label_name hash",
+		"var_label le upstream",
+	} {
+		input := "extend_metrics {\n\t\tregistry custom:test_reserved_label_names\n\t\t" + directive + "\n\t}"
+		_, err := provisionTestHandler(t, newTestContext(t), input)
+		if err == nil || !strings.Contains(err.Error(), "reserved label name") {
+			t.Errorf("%q: expected a reserved label name error, got %v", directive, err)
+		}
+	}
+
+	if _, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_reserved_label_names
+		host_label_name vhost
+		code_label_name status
+	}`); err != nil {
+		t.Errorf("expected unreserved label names to be accepted: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package extend_metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// acquireSlot waits for one of the max_concurrent slots, for at most
+// max_concurrent_wait. Without max_concurrent_wait requests queue with no
+// time limit, until a slot frees up or the client goes away. The returned
+// function releases the slot; when none could be acquired in time the
+// request is rejected with a 503.
+//
+// Queued requests are not in flight yet: callers acquire the slot before
+// counting the request in `requests_in_flight`, so that the gauge never
+// exceeds the limit.
+func (c *CaddyMetrics) acquireSlot(r *http.Request, host string) (func(), error) {
+	start := c.clock.Now()
+	labels := prometheus.Labels{c.hostKey: host}
+
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		var timeout <-chan time.Time
+		if c.MaxConcurrentWait > 0 {
+			timer := time.NewTimer(time.Duration(c.MaxConcurrentWait))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case c.slots <- struct{}{}:
+		case <-timeout:
+			if c.metrics != nil {
+				c.metrics.concurrencyRejections.With(labels).Inc()
+			}
+			return nil, caddyhttp.Error(http.StatusServiceUnavailable,
+				fmt.Errorf("no concurrency slot available within %v", time.Duration(c.MaxConcurrentWait)))
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+
+	if c.metrics != nil {
+		c.metrics.concurrencyWait.With(labels).Observe(c.clock.Now().Sub(start).Seconds())
+	}
+	return func() { <-c.slots }, nil
+}
@@ -0,0 +1,94 @@
+package extend_metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxConcurrent(t *testing.T) {
+	const spec = "custom:test_max_concurrent"
+	c, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_max_concurrent
+		max_concurrent 1 100ms
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlight := c.metrics.requestInFlight.WithLabelValues("example.com")
+
+	var mu sync.Mutex
+	var maxInFlight float64
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	blocked := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		mu.Lock()
+		maxInFlight = max(maxInFlight, testutil.ToFloat64(inFlight))
+		mu.Unlock()
+		entered <- struct{}{}
+		<-release
+		return nil
+	})
+	serve := func(ctx context.Context) <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(ctx)
+			repl := caddyhttp.NewTestReplacer(r)
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+			errs <- c.ServeHTTP(httptest.NewRecorder(), r, blocked)
+		}()
+		return errs
+	}
+
+	first := serve(context.Background())
+	<-entered
+
+	// queues for longer than max_concurrent_wait
+	var handlerErr caddyhttp.HandlerError
+	if err := <-serve(context.Background()); !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 once the wait is over, got %v", err)
+	}
+
+	// gives up while queuing
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := serve(ctx)
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the canceled request to give up, got %v", err)
+	}
+
+	// gets the slot once the first request is done
+	queued := serve(context.Background())
+	time.Sleep(10 * time.Millisecond)
+	release <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	release <- struct{}{}
+	if err := <-queued; err != nil {
+		t.Errorf("expected the queued request to go through, got %v", err)
+	}
+
+	if maxInFlight != 1 {
+		t.Errorf("expected at most 1 request in flight, got %v", maxInFlight)
+	}
+	samples := scrapeTestRegistry(t, spec)
+	for _, want := range []string{
+		`caddy_http_extend_concurrency_rejections_total{host="example.com"} 1`,
+		`caddy_http_extend_concurrency_wait_seconds_count{host="example.com"} 2`,
+	} {
+		if !strings.Contains(samples, want) {
+			t.Errorf("expected %s, got:\n%s", want, samples)
+		}
+	}
+}
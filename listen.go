@@ -0,0 +1,63 @@
+package extend_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const metricsServerShutdownTimeout = 5 * time.Second
+
+// metricsServer serves a registry on a dedicated listener, away from the
+// data plane, so that the metrics endpoint can be firewalled separately.
+type metricsServer struct {
+	server *http.Server
+}
+
+// startMetricsServer listens on addr, which is a Caddy network address such
+// as `localhost:9180` or `unix//run/caddy-metrics.sock`, and serves reg on
+// every path.
+func startMetricsServer(ctx caddy.Context, addr string, reg *registryRef, logger *zap.Logger) (*metricsServer, error) {
+	na, err := caddy.ParseNetworkAddress(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing listen address: %v", err)
+	}
+	if na.PortRangeSize() > 1 {
+		return nil, fmt.Errorf("listen address must be a single address: %s", addr)
+	}
+
+	lnAny, err := na.Listen(ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", addr, err)
+	}
+	ln, ok := lnAny.(net.Listener)
+	if !ok {
+		return nil, fmt.Errorf("listen address is not a stream network: %s", addr)
+	}
+
+	s := &metricsServer{
+		server: &http.Server{
+			Handler:           newRegistryHandler(reg, logger, true),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server stopped", zap.String("address", addr), zap.Error(err))
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *metricsServer) stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsServerShutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
@@ -1,84 +1,842 @@
 package extend_metrics
 
 import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-var httpMetrics = struct {
-	init             sync.Once
+type metrics struct {
+	// collectors are all of the collectors below, for the admin endpoint
+	// deleting series.
+	collectors []prometheus.Collector
+
+	// config is the config of the instance, and owned the collectors it
+	// uses in each registry.
+	config configID
+	owned  []collectorKey
+
 	requestInFlight  *prometheus.GaugeVec
 	requestCount     *prometheus.CounterVec
 	requestErrors    *prometheus.CounterVec
-	requestDuration  *prometheus.HistogramVec
-	requestSize      *prometheus.HistogramVec
-	responseSize     *prometheus.HistogramVec
-	responseDuration *prometheus.HistogramVec
-}{
-	init: sync.Once{},
+	requestsAborted  *prometheus.CounterVec
+	requestDuration  prometheus.ObserverVec
+	requestSize      prometheus.ObserverVec
+	responseSize     prometheus.ObserverVec
+	responseDuration prometheus.ObserverVec
+
+	requestInFlightMax             *prometheus.GaugeVec
+	processGoroutines              prometheus.GaugeFunc
+	requestInFlightByPathPrefix    *prometheus.GaugeVec
+	requestsBelowDurationThreshold *prometheus.CounterVec
+	responsesBelowTTFBThreshold    *prometheus.CounterVec
+	smallResponses                 *prometheus.CounterVec
+	responses                      *prometheus.CounterVec
+	histogramSampleRate            *prometheus.GaugeVec
+	tlsHandshakeDuration           *prometheus.HistogramVec
+	tlsCertExpiry                  *prometheus.GaugeVec
+	requestsExcluded               *prometheus.CounterVec
+	websocketInFlight              *prometheus.GaugeVec
+	websocketDuration              *prometheus.HistogramVec
+	queueWait                      *prometheus.HistogramVec
+	requestInterarrival            *prometheus.HistogramVec
+	requestQueryParamCount         *prometheus.HistogramVec
+	responseCompressionRatio       *prometheus.HistogramVec
+	responseHeaderDelta            *prometheus.HistogramVec
+	responsesBuffered              *prometheus.CounterVec
+	ttfbFallback                   *prometheus.CounterVec
+	responseBufferFlush            *prometheus.HistogramVec
+	requestsBuffering              *prometheus.GaugeVec
+	requestBodyRead                *prometheus.HistogramVec
+	contentLengthMismatch          *prometheus.CounterVec
+	responsesWithTrailers          *prometheus.CounterVec
+	grpcStatus                     *prometheus.CounterVec
+	revalidations                  *prometheus.CounterVec
+	handlerUp                      *prometheus.GaugeVec
+	connectionRequestNumber        *prometheus.HistogramVec
+	h2ConcurrentStreams            *prometheus.HistogramVec
+	requestHeaderSize              *prometheus.HistogramVec
+	errorBodyClass                 *prometheus.CounterVec
+	acceptToHandler                *prometheus.HistogramVec
+	responseFlushCount             *prometheus.HistogramVec
+	retryAfter                     *prometheus.HistogramVec
+	bodyLimitExceeded              *prometheus.CounterVec
+	responseAge                    *prometheus.HistogramVec
+	requestIngressRate             *prometheus.HistogramVec
+	handlerChainDepth              *prometheus.HistogramVec
+	configInfo                     *prometheus.GaugeVec
+	bucketConfig                   *prometheus.GaugeVec
+	errorResponseDuration          *prometheus.HistogramVec
+	responseWriteErrors            *prometheus.CounterVec
+	responseSetCookieCount         *prometheus.HistogramVec
+	concurrencyWait                *prometheus.HistogramVec
+	concurrencyRejections          *prometheus.CounterVec
+	requestDurationFast            *prometheus.HistogramVec
+	requestDurationSlow            *prometheus.HistogramVec
+	writeRequestDuration           *prometheus.HistogramVec
+	serverDuration                 prometheus.ObserverVec
 }
 
 func init() {
 	caddy.RegisterModule(CaddyMetrics{})
 	httpcaddyfile.RegisterHandlerDirective("extend_metrics", parseCaddyfile)
+}
+
+// registration registers collectors into one or more registries,
+// remembering the first error encountered.
+type registration struct {
+	regs []prometheus.Registerer
+	err  error
+
+	// collectors are the collectors registered so far, or adopted.
+	collectors []prometheus.Collector
+
+	// config is the config of the instance, and owned the collectors it
+	// uses in each registry, released once it is cleaned up.
+	config configID
+	owned  []collectorKey
+
+	// constLabels are the const labels of some of the metrics, by name
+	// without the namespace and subsystem, and applied the names they
+	// were applied to.
+	constLabels map[string]map[string]string
+	applied     map[string]bool
+}
+
+// registerers returns the registries c goes into, wrapped to add the const
+// labels of its metric if any, along with that metric's name.
+func (r *registration) registerers(c prometheus.Collector) ([]prometheus.Registerer, string) {
+	if len(r.constLabels) == 0 {
+		return r.regs, ""
+	}
+	name := metricName(c)
+	labels, ok := r.constLabels[name]
+	if !ok {
+		return r.regs, ""
+	}
+	r.applied[name] = true
+	regs := make([]prometheus.Registerer, len(r.regs))
+	for i, reg := range r.regs {
+		regs[i] = prometheus.WrapRegistererWith(prometheus.Labels(labels), reg)
+	}
+	return regs, name
+}
+
+// metricName returns the name of the metric collected by c, without the
+// namespace and subsystem. Descs don't expose their name other than through
+// their String method.
+func metricName(c prometheus.Collector) string {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+	var name string
+	for desc := range ch {
+		const prefix = `Desc{fqName: `
+		if s := desc.String(); name == "" && strings.HasPrefix(s, prefix) {
+			if quoted, err := strconv.QuotedPrefix(s[len(prefix):]); err == nil {
+				name, _ = strconv.Unquote(quoted)
+			}
+		}
+	}
+	return strings.TrimPrefix(name, "caddy_http_extend_")
+}
+
+// register registers c, or returns the equivalent collector if one was
+// already registered by another instance of the handler. With several
+// registries the same collector is registered into each of them, so that
+// every observation shows in all of them; a collector found in one of them
+// is adopted for all, such as when a reload adds a registry. A collector of
+// a config being replaced that can't be adopted, as its type, label names
+// or buckets differ, is replaced.
+func register[T prometheus.Collector](r *registration, c T) T {
+	if r.err != nil {
+		forgetBuckets(c)
+		return c
+	}
+	regs, constLabelsOf := r.registerers(c)
+	name := metricName(c)
+	slotID := name
+	if constLabelsOf != "" {
+		labels := r.constLabels[constLabelsOf]
+		// slots are unchecked, so check the const labels against the
+		// label names of c on their own
+		if err := prometheus.WrapRegistererWith(labels, prometheus.NewRegistry()).Register(c); err != nil {
+			r.err = fmt.Errorf("const_labels_for %s: %v", constLabelsOf, err)
+			return c
+		}
+		slotID += fmt.Sprint(labels)
+	}
+
+	registeredCollectors.mu.Lock()
+	defer registeredCollectors.mu.Unlock()
+
+	slots := make([]*collectorSlot, len(regs))
+	for i, reg := range regs {
+		key := slotKey{reg: registryOf(r.regs[i]), id: slotID}
+		slot, ok := registeredCollectors.slots[key]
+		if !ok {
+			slot = new(collectorSlot)
+			if err := reg.Register(slot); err != nil {
+				r.err = err
+				return c
+			}
+			registeredCollectors.slots[key] = slot
+		}
+		slots[i] = slot
+	}
+
+	var adopted prometheus.Collector = c
+	for _, slot := range slots {
+		if current := slot.get(); current != nil && compatible[T](current, c) {
+			adopted = current
+			break
+		}
+	}
+	for i, slot := range slots {
+		current := slot.get()
+		if current == nil || current == adopted || !ownedBy(collectorKey{registryOf(r.regs[i]), current}, r.config) {
+			continue
+		}
+		if compatible[T](current, c) {
+			// two instances registered their own collectors into
+			// different registries, which one collector can't join
+			r.err = fmt.Errorf("%s is registered into another registry by another handler; handlers sharing one of their registries must list the same registries", name)
+		} else {
+			r.err = fmt.Errorf("%s is registered with other labels, type or buckets by another handler; handlers sharing a registry must enable the same labels and histograms, or use separate registries", name)
+		}
+		return c
+	}
+
+	for i, slot := range slots {
+		key := collectorKey{reg: registryOf(r.regs[i]), c: adopted}
+		own(key, slot, r.config)
+		r.owned = append(r.owned, key)
+	}
+	if any(adopted) != any(c) {
+		forgetBuckets(c)
+		c = adopted.(T)
+	}
+	r.collectors = append(r.collectors, c)
+	return c
+}
+
+// compatible tells whether the collector current can be adopted in place
+// of c, of type T: it describes the same metric with the same buckets.
+func compatible[T prometheus.Collector](current, c prometheus.Collector) bool {
+	_, ok := current.(T)
+	return ok && describe(current) == describe(c) && sameBuckets(current, c)
+}
+
+// describe returns the descs of c as text.
+func describe(c prometheus.Collector) string {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+	var sb strings.Builder
+	for desc := range ch {
+		sb.WriteString(desc.String())
+	}
+	return sb.String()
+}
+
+// registerObserver registers a histogram, or with summary_only a summary
+// without quantiles in its place, which only exposes the count and sum.
+// Duration histograms take the host bucket overrides into account.
+func registerObserver(r *registration, c *CaddyMetrics, opts prometheus.HistogramOpts, labels []string, duration bool) prometheus.ObserverVec {
+	if c.SummaryOnly {
+		return register(r, prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: opts.Namespace,
+			Subsystem: opts.Subsystem,
+			Name:      opts.Name,
+			Help:      opts.Help,
+		}, labels))
+	}
+	if duration && len(c.HostBuckets) > 0 {
+		return register(r, newHostBucketsVec(opts, labels, c.hostKey, c.HostBuckets))
+	}
+	return register(r, newHistogramVec(opts, labels))
+}
+
+// histogramBuckets holds the buckets of the histograms created by
+// newHistogramVec, which the vectors don't expose, until they are dropped.
+var histogramBuckets sync.Map // *prometheus.HistogramVec -> []float64
+
+// newHistogramVec returns a histogram vector, remembering its buckets.
+func newHistogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	vec := prometheus.NewHistogramVec(opts, labels)
+	buckets := opts.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	histogramBuckets.Store(vec, buckets)
+	return vec
+}
+
+// bucketsOf returns the buckets of the histogram c, along with those of
+// its host overrides if any.
+func bucketsOf(c prometheus.Collector) ([]float64, bool) {
+	switch v := c.(type) {
+	case *prometheus.HistogramVec:
+		if buckets, ok := histogramBuckets.Load(v); ok {
+			return buckets.([]float64), true
+		}
+	case *hostBucketsVec:
+		return v.buckets, true
+	}
+	return nil, false
+}
 
+// sameBuckets tells whether two collectors of a type have the same
+// buckets, which is always the case of collectors without any.
+func sameBuckets(a, b prometheus.Collector) bool {
+	ab, _ := bucketsOf(a)
+	bb, _ := bucketsOf(b)
+	if !slices.Equal(ab, bb) {
+		return false
+	}
+	ah, aok := a.(*hostBucketsVec)
+	bh, bok := b.(*hostBucketsVec)
+	return !aok || !bok || slices.EqualFunc(ah.overrides, bh.overrides, func(x, y hostBucketsOverride) bool {
+		return x.host == y.host && slices.Equal(x.buckets, y.buckets)
+	})
+}
+
+// forgetBuckets drops the buckets remembered for c.
+func forgetBuckets(c prometheus.Collector) {
+	histogramBuckets.Delete(c)
+}
+
+const bucketPresetPrefix = "preset:"
+
+// bucketPresets are named duration bucket sets, usable in the Caddyfile as
+// `preset:<name>` instead of a list of boundaries.
+var bucketPresets = map[string][]float64{
+	// fine-grained sub-second buckets for pages and assets
+	"web": {.005, .01, .025, .05, .075, .1, .15, .2, .3, .5, .75, 1, 2.5},
+	// typical API latencies, up to half a minute
+	"api": {.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	// coarse buckets for long-running jobs, up to an hour
+	"batch": {1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+}
+
+// validateBuckets checks that buckets are strictly increasing, which the
+// histogram constructors would otherwise panic on.
+func validateBuckets(name string, buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("%s must be in strictly increasing order: %v", name, buckets)
+		}
+	}
+	return nil
+}
+
+func (c *CaddyMetrics) durationBuckets() []float64 {
+	if len(c.DurationBuckets) > 0 {
+		return c.DurationBuckets
+	}
+	return prometheus.DefBuckets
+}
+
+func (c *CaddyMetrics) sizeBuckets() []float64 {
+	if len(c.SizeBuckets) > 0 {
+		return c.SizeBuckets
+	}
+	return prometheus.ExponentialBuckets(256, 4, 8)
+}
+
+// liveBuckets returns the buckets of the configurable histograms by
+// metric name, without the namespace and subsystem. They are the buckets
+// of the histograms registered, which were possibly adopted from another
+// handler.
+func (m *metrics) liveBuckets() map[string][]float64 {
+	histograms := map[string]prometheus.Collector{
+		"request_duration_seconds":  m.requestDuration,
+		"response_duration_seconds": m.responseDuration,
+		"request_size_bytes":        m.requestSize,
+		"response_size_bytes":       m.responseSize,
+	}
+	if m.requestDurationFast != nil {
+		histograms["request_duration_fast_seconds"] = m.requestDurationFast
+	}
+	if m.requestDurationSlow != nil {
+		histograms["request_duration_slow_seconds"] = m.requestDurationSlow
+	}
+	buckets := make(map[string][]float64)
+	for name, histogram := range histograms {
+		if b, ok := bucketsOf(histogram); ok {
+			buckets[name] = b
+		}
+	}
+	return buckets
+}
+
+// newMetrics creates the collectors needed by c and registers them into regs.
+// The set of collectors and their label names depend on the config, so each
+// instance builds its own from Provision. Collectors another instance
+// already registered with the same schema are reused, which makes calling
+// it repeatedly and concurrently safe.
+func newMetrics(regs []prometheus.Registerer, c *CaddyMetrics, config configID) (*metrics, error) {
 	const ns, sub = "caddy", "http_extend"
 
-	basicLabels := []string{"host"}
-	httpMetrics.requestInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	m := new(metrics)
+	r := &registration{regs: regs, constLabels: c.ConstLabelsFor, applied: make(map[string]bool), config: config}
+
+	basicLabels := []string{c.hostKey}
+	m.requestInFlight = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "requests_in_flight",
 		Help:      "Number of requests currently handled by this server.",
-	}, basicLabels)
-	httpMetrics.requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	}, basicLabels))
+	if c.InFlightMaxWindow > 0 {
+		m.requestInFlightMax = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "requests_in_flight_max",
+			Help:      "Highest number of requests handled concurrently by this server during the last window.",
+		}, basicLabels))
+	}
+	if c.ProcessGoroutines {
+		m.processGoroutines = register(r, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "process_goroutines",
+			Help:      "Number of goroutines of the process.",
+		}, func() float64 { return float64(runtime.NumGoroutine()) }))
+	}
+	if len(c.InFlightPathPrefixes) > 0 {
+		m.requestInFlightByPathPrefix = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "requests_in_flight_by_path_prefix",
+			Help:      "Number of requests currently handled by this server, by path prefix.",
+		}, []string{c.hostKey, "path_prefix"}))
+	}
+	m.requestErrors = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "request_errors_total",
 		Help:      "Number of requests resulting in middleware errors.",
-	}, basicLabels)
-	httpMetrics.requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	}, basicLabels))
+	m.requestCount = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "requests_total",
 		Help:      "Counter of HTTP(S) requests made.",
-	}, basicLabels)
+	}, basicLabels))
+	if c.Aborts {
+		m.requestsAborted = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "requests_aborted_total",
+			Help:      "Number of requests aborted without a response.",
+		}, basicLabels))
+	}
+	if c.HandlerUp != "" {
+		m.handlerUp = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "handler_up",
+			Help:      "Whether the handler is provisioned and serving, always 1.",
+		}, []string{"name", "caddy_version"}))
+	}
+	if c.ConfigInfo {
+		m.configInfo = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "config_info",
+			Help:      "Hash of the config of the provisioned handlers, always 1.",
+		}, []string{"hash"}))
+	}
 
-	// TODO: allow these to be customized in the config
-	durationBuckets := prometheus.DefBuckets
-	sizeBuckets := prometheus.ExponentialBuckets(256, 4, 8)
+	durationBuckets := c.durationBuckets()
+	sizeBuckets := c.sizeBuckets()
 
-	httpLabels := []string{"host", "code", "method"}
-	httpMetrics.requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	// labels only known once the response is complete can't be on the
+	// time to first byte histogram
+	headerLabels := c.httpLabelNames()
+	httpLabels := append(headerLabels[:len(headerLabels):len(headerLabels)], c.completionLabelNames()...)
+	m.requestDuration = registerObserver(r, c, prometheus.HistogramOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "request_duration_seconds",
 		Help:      "Histogram of round-trip request durations.",
 		Buckets:   durationBuckets,
-	}, httpLabels)
-	httpMetrics.requestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	}, httpLabels, true)
+	m.requestSize = registerObserver(r, c, prometheus.HistogramOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "request_size_bytes",
 		Help:      "Total size of the request. Includes body",
 		Buckets:   sizeBuckets,
-	}, httpLabels)
-	httpMetrics.responseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	}, httpLabels, false)
+	m.responseSize = registerObserver(r, c, prometheus.HistogramOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "response_size_bytes",
 		Help:      "Size of the returned response.",
 		Buckets:   sizeBuckets,
-	}, httpLabels)
-	httpMetrics.responseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	}, httpLabels, false)
+	m.responseDuration = registerObserver(r, c, prometheus.HistogramOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "response_duration_seconds",
 		Help:      "Histogram of times to first byte in response bodies.",
 		Buckets:   durationBuckets,
-	}, httpLabels)
+	}, headerLabels, true)
+	if c.ServerDuration {
+		m.serverDuration = registerObserver(r, c, prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "server_duration_seconds",
+			Help:      "Histogram of durations from the start of the request to the first byte of the response.",
+			Buckets:   durationBuckets,
+		}, httpLabels, true)
+	}
+	m.errorResponseDuration = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "error_response_duration_seconds",
+		Help:      "Histogram of round-trip durations of 4xx and 5xx responses.",
+		Buckets:   durationBuckets,
+	}, []string{c.hostKey, c.codeKey}))
+	if c.ResponseWriteErrors {
+		m.responseWriteErrors = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "response_write_errors_total",
+			Help:      "Number of responses which failed to be written out to the client.",
+		}, []string{c.hostKey, c.codeKey}))
+	}
+	m.requestsBelowDurationThreshold = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_below_duration_threshold_total",
+		Help:      "Number of requests faster than the minimum duration threshold, which are not observed in the round-trip duration histogram.",
+	}, httpLabels))
+	m.responsesBelowTTFBThreshold = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "responses_below_ttfb_threshold_total",
+		Help:      "Number of responses faster to first byte than the minimum threshold, which are not observed in the time to first byte histogram.",
+	}, headerLabels))
+	m.smallResponses = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "small_responses_total",
+		Help:      "Number of responses smaller than the minimum response size, which are not observed in the response size histogram.",
+	}, httpLabels))
+	if c.HistogramSampleRate > 0 && c.HistogramSampleRate < 1 {
+		m.responses = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "responses_total",
+			Help:      "Number of responses, including those not sampled into the histograms.",
+		}, httpLabels))
+		m.histogramSampleRate = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "histogram_sample_rate",
+			Help:      "Fraction of requests observed in the round-trip duration, time to first byte and size histograms.",
+		}, basicLabels))
+	}
+	m.tlsHandshakeDuration = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "tls_handshake_duration_seconds",
+		Help:      "Histogram of TLS handshake durations, observed once per connection.",
+		Buckets:   durationBuckets,
+	}, basicLabels))
+	m.tlsCertExpiry = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "tls_cert_expiry_seconds",
+		Help:      "Seconds until the certificate served to TLS requests expires.",
+	}, basicLabels))
+	m.acceptToHandler = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "accept_to_handler_seconds",
+		Help:      "Histogram of times from accepting a connection until its first request reaches the handler.",
+		Buckets:   durationBuckets,
+	}, basicLabels))
+	m.concurrencyWait = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "concurrency_wait_seconds",
+		Help:      "Histogram of times requests queued for a max_concurrent slot.",
+		Buckets:   durationBuckets,
+	}, basicLabels))
+	m.concurrencyRejections = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "concurrency_rejections_total",
+		Help:      "Number of requests rejected after queuing for a max_concurrent slot for too long.",
+	}, basicLabels))
+	m.requestsExcluded = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_excluded_total",
+		Help:      "Number of requests left unobserved because of their host, path, status code or sampling.",
+	}, []string{c.hostKey, "reason"}))
+	m.websocketInFlight = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "websocket_connections_in_flight",
+		Help:      "Number of upgraded WebSocket connections currently open.",
+	}, basicLabels))
+	m.websocketDuration = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "websocket_connection_duration_seconds",
+		Help:      "Histogram of WebSocket connection lifetimes.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, basicLabels))
+	m.queueWait = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "queue_wait_seconds",
+		Help:      "Histogram of times between entering this handler and the next extend_metrics handler down the chain.",
+		Buckets:   durationBuckets,
+	}, basicLabels))
+	if c.Interarrival {
+		m.requestInterarrival = register(r, newHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "request_interarrival_seconds",
+			Help:      "Histogram of times between consecutive requests to each host.",
+			Buckets:   prometheus.ExponentialBuckets(.0001, 4, 10),
+		}, basicLabels))
+	}
+	if c.CompressionRatioHeader != "" {
+		m.responseCompressionRatio = register(r, newHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "response_compression_ratio",
+			Help:      "Histogram of the uncompressed over the compressed sizes of encoded responses.",
+			Buckets:   []float64{1, 1.5, 2, 3, 4, 6, 8, 12, 16},
+		}, basicLabels))
+	}
+	if c.QueryParamCount {
+		m.requestQueryParamCount = register(r, newHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "request_query_param_count",
+			Help:      "Histogram of the number of query parameters of requests.",
+			Buckets:   []float64{0, 1, 2, 4, 8, 16, 32, 64},
+		}, basicLabels))
+	}
+	m.responseHeaderDelta = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_header_delta",
+		Help:      "Histogram of the number of response header fields added by the rest of the handler chain.",
+		Buckets:   []float64{-8, -4, -2, -1, 0, 1, 2, 4, 8, 16, 32},
+	}, basicLabels))
+	m.responseSetCookieCount = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_set_cookie_count",
+		Help:      "Histogram of the number of Set-Cookie header fields of responses.",
+		Buckets:   []float64{0, 1, 2, 3, 5, 10, 20, 50},
+	}, basicLabels))
+	m.responsesBuffered = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "responses_buffered_total",
+		Help:      "Number of responses buffered by the handler rather than streamed.",
+	}, basicLabels))
+	if c.TTFBFallback {
+		m.ttfbFallback = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "ttfb_fallback_total",
+			Help:      "Number of requests whose status code was set after the handler returned, without a time to first byte observed.",
+		}, basicLabels))
+	}
+	if c.BufferingInFlight {
+		m.requestsBuffering = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "requests_buffering_in_flight",
+			Help:      "Number of responses currently buffered in memory by the handler.",
+		}, basicLabels))
+	}
+	if c.BufferFlushDuration {
+		m.responseBufferFlush = register(r, newHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "response_buffer_flush_seconds",
+			Help:      "Histogram of the time spent writing buffered responses out to the client.",
+			Buckets:   prometheus.ExponentialBuckets(.0001, 4, 8),
+		}, basicLabels))
+	}
+	m.requestBodyRead = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "request_body_read_seconds",
+		Help:      "Histogram of times spent blocked reading request bodies.",
+		Buckets:   durationBuckets,
+	}, basicLabels))
+	m.handlerChainDepth = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "handler_chain_depth",
+		Help:      "Histogram of the deepest nesting of extend_metrics handlers requests reached.",
+		Buckets:   []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20},
+	}, basicLabels))
+	m.requestIngressRate = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "request_ingress_bytes_per_second",
+		Help:      "Histogram of request body read throughputs, the bytes read per second spent blocked reading them.",
+		Buckets:   prometheus.ExponentialBuckets(1<<10, 4, 10),
+	}, basicLabels))
+	m.contentLengthMismatch = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "content_length_mismatch_total",
+		Help:      "Number of responses whose declared Content-Length differs from the bytes written.",
+	}, basicLabels))
+
+	m.responsesWithTrailers = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "responses_with_trailers_total",
+		Help:      "Number of responses which included trailers.",
+	}, basicLabels))
+	m.grpcStatus = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "grpc_status_total",
+		Help:      "Number of gRPC responses by grpc-status.",
+	}, []string{c.hostKey, "grpc_status"}))
+	m.connectionRequestNumber = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "connection_request_number",
+		Help:      "Histogram of the number of each request on its connection, starting at 1.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	}, basicLabels))
+	m.h2ConcurrentStreams = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "h2_concurrent_streams",
+		Help:      "Histogram of the number of requests in flight through this handler on the HTTP/2 connection of each request, itself included.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 9),
+	}, basicLabels))
+	m.requestHeaderSize = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "request_header_size_bytes",
+		Help:      "Histogram of the sizes of selected request headers.",
+		Buckets:   prometheus.ExponentialBuckets(16, 2, 11),
+	}, []string{c.hostKey, "header"}))
+	m.errorBodyClass = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "error_body_class_total",
+		Help:      "Number of 5xx responses by a class derived from their body.",
+	}, []string{c.hostKey, "class"}))
+	m.responseFlushCount = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_flush_count",
+		Help:      "Histogram of the number of times responses were flushed.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 1000},
+	}, basicLabels))
+	m.retryAfter = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "retry_after_seconds",
+		Help:      "Histogram of the delays asked for by the Retry-After header of 429 and 503 responses.",
+		Buckets:   []float64{0, 1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	}, basicLabels))
+	m.responseAge = register(r, newHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_age_seconds",
+		Help:      "Histogram of the ages responses report in the configured age header.",
+		Buckets:   []float64{0, 1, 10, 60, 300, 900, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600},
+	}, basicLabels))
+	m.bodyLimitExceeded = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "body_limit_exceeded_total",
+		Help:      "Number of requests whose body exceeded a size limit.",
+	}, basicLabels))
+	m.revalidations = register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "revalidations_total",
+		Help:      "Number of 304 Not Modified responses to conditional requests.",
+	}, basicLabels))
+
+	if len(c.DurationFastBuckets) > 0 {
+		m.requestDurationFast = register(r, newHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "request_duration_fast_seconds",
+			Help:      "Histogram of round-trip request durations, with buckets tuned for the fast path.",
+			Buckets:   c.DurationFastBuckets,
+		}, httpLabels))
+	}
+	if len(c.DurationSlowBuckets) > 0 {
+		m.requestDurationSlow = register(r, newHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "request_duration_slow_seconds",
+			Help:      "Histogram of round-trip request durations, with buckets tuned for the long tail.",
+			Buckets:   c.DurationSlowBuckets,
+		}, httpLabels))
+	}
+	if c.BucketConfigInfo {
+		m.bucketConfig = register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "histogram_bucket_config",
+			Help:      "Upper bounds of the buckets of the configurable histograms, always 1.",
+		}, []string{"metric", "le"}))
+	}
+	if len(c.WriteMethods) > 0 {
+		m.writeRequestDuration = register(r, newHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "write_request_duration_seconds",
+			Help:      "Histogram of round-trip request durations of write requests.",
+			Buckets:   durationBuckets,
+		}, basicLabels))
+	}
+
+	if r.err == nil {
+		for name := range c.ConstLabelsFor {
+			if !r.applied[name] {
+				r.err = fmt.Errorf("const_labels_for %s: no such metric is enabled", name)
+			}
+		}
+	}
+	if r.err != nil {
+		releaseCollectors(r.owned, config)
+		return nil, r.err
+	}
+	m.collectors = r.collectors
+	m.config, m.owned = config, r.owned
+	return m, nil
+}
+
+// release drops the collectors of m, unregistering the ones no other
+// instance uses.
+func (m *metrics) release() {
+	releaseCollectors(m.owned, m.config)
 }
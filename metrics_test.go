@@ -0,0 +1,84 @@
+package extend_metrics
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBucketConfigInfoReload(t *testing.T) {
+	const spec = "custom:test_bucket_config_info"
+	old, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_bucket_config_info
+		bucket_config_info
+		duration_buckets 1 2 3
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_bucket_config_info
+		bucket_config_info
+		duration_buckets 10 20
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	old.Cleanup()
+
+	samples := scrapeTestRegistry(t, spec)
+	for _, want := range []string{
+		`caddy_http_extend_histogram_bucket_config{le="10",metric="request_duration_seconds"} 1`,
+		`caddy_http_extend_histogram_bucket_config{le="20",metric="response_duration_seconds"} 1`,
+	} {
+		if !strings.Contains(samples, want) {
+			t.Errorf("expected %s, got:\n%s", want, samples)
+		}
+	}
+	if strings.Contains(samples, `histogram_bucket_config{le="3"`) {
+		t.Errorf("expected the buckets of the previous config to be gone, got:\n%s", samples)
+	}
+}
+
+func TestHistogramSampleRatePerHost(t *testing.T) {
+	const spec = "custom:test_histogram_sample_rate"
+	ctx := newTestContext(t)
+	half, err := provisionTestHandler(t, ctx, `extend_metrics {
+		registry custom:test_histogram_sample_rate
+		histogram_sample_rate 0.5
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarter, err := provisionTestHandler(t, ctx, `extend_metrics {
+		registry custom:test_histogram_sample_rate
+		histogram_sample_rate 0.25
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestRequest(half, "GET", "http://a.example.com/", okHandler)
+	serveTestRequest(quarter, "GET", "http://b.example.com/", okHandler)
+
+	rates := func() []string {
+		var rates []string
+		for _, line := range strings.Split(scrapeTestRegistry(t, spec), "\n") {
+			if strings.HasPrefix(line, "caddy_http_extend_histogram_sample_rate{") {
+				rates = append(rates, line)
+			}
+		}
+		sort.Strings(rates)
+		return rates
+	}
+	want := []string{
+		`caddy_http_extend_histogram_sample_rate{host="a.example.com"} 0.5`,
+		`caddy_http_extend_histogram_sample_rate{host="b.example.com"} 0.25`,
+	}
+	if got := rates(); !slices.Equal(got, want) {
+		t.Errorf("expected a histogram_sample_rate series per host, got %v", got)
+	}
+	half.Cleanup()
+	if got := rates(); !slices.Equal(got, want[1:]) {
+		t.Errorf("expected only the series of the remaining handler, got %v", got)
+	}
+}
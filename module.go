@@ -1,23 +1,138 @@
 package extend_metrics
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// Values of the reason label of requests_excluded_total.
+const (
+	excludedPath     = "path"
+	excludedCode     = "code"
+	excludedSampling = "sampling"
+	excludedHost     = "host"
+)
+
+// defaultWriteMethods are the write_methods of the Caddyfile directive
+// given without arguments.
+var defaultWriteMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
 const (
 	ServerCtxKey caddy.CtxKey = "server"
+
+	// TLSHandshakeCtxKey is the context key under which a *TLSHandshake may
+	// be stored for each connection.
+	TLSHandshakeCtxKey caddy.CtxKey = "tls_handshake"
+
+	// ConnAcceptCtxKey is the context key under which a *ConnAccept may be
+	// stored for each connection.
+	ConnAcceptCtxKey caddy.CtxKey = "conn_accept"
+
+	// ServingCertificateCtxKey is the context key under which the
+	// *x509.Certificate served on a connection may be stored.
+	ServingCertificateCtxKey caddy.CtxKey = "serving_certificate"
+
+	queueWaitCtxKey caddy.CtxKey = "extend_metrics_queue_wait"
+
+	chainDepthCtxKey caddy.CtxKey = "extend_metrics_chain_depth"
 )
 
-func computeApproximateRequestSize(r *http.Request) int {
+// TLSHandshake carries the measured TLS handshake duration of a connection.
+//
+// Neither Go's http.Server nor Caddy record handshake timings, and by the
+// time a request reaches this handler the handshake is long over, so it
+// cannot be measured here. Whatever performs the handshake (a custom
+// listener or ConnContext hook) must store one of these in the connection
+// context under TLSHandshakeCtxKey; without it the
+// tls_handshake_duration_seconds histogram stays empty rather than
+// reporting guesses.
+type TLSHandshake struct {
+	Duration time.Duration
+
+	observed atomic.Bool
+}
+
+// ConnAccept carries the time a connection was accepted.
+//
+// Caddy doesn't record accept times, so whatever accepts the connection (a
+// listener wrapper or ConnContext hook) must store one of these in the
+// connection context under ConnAcceptCtxKey; without it the
+// accept_to_handler_seconds histogram stays empty. Later requests on a
+// connection would include the time it sat idle, so only the first one is
+// observed.
+type ConnAccept struct {
+	Time time.Time
+
+	observed atomic.Bool
+}
+
+// queueMark is left in the request context by an instance measuring queue
+// wait. The next instance down the handler chain records how long after the
+// outer instance's start it was reached.
+type queueMark struct {
+	clock Clock
+	start time.Time
+	wait  atomic.Int64
+}
+
+func (m *queueMark) reached() {
+	m.wait.CompareAndSwap(0, int64(m.clock.Now().Sub(m.start)))
+}
+
+// chainDepth counts the `extend_metrics` handlers a request is nested in.
+// Caddy keeps no count of the handlers a request traverses, so only the
+// instances of this handler can be counted: each one found in the context
+// by an inner instance adds a level while the request is inside it.
+type chainDepth struct {
+	current atomic.Int64
+	max     atomic.Int64
+}
+
+func (d *chainDepth) enter() {
+	n := d.current.Add(1)
+	for {
+		max := d.max.Load()
+		if n <= max || d.max.CompareAndSwap(max, n) {
+			return
+		}
+	}
+}
+
+func (d *chainDepth) leave() {
+	d.current.Add(-1)
+}
+
+// roundDuration rounds d to the configured duration resolution.
+func (c *CaddyMetrics) roundDuration(d time.Duration) time.Duration {
+	if c.DurationResolution <= 0 {
+		return d
+	}
+	return d.Round(time.Duration(c.DurationResolution))
+}
+
+func computeApproximateRequestSize(r *http.Request, includeBody bool) int {
 	s := 0
 	if r.URL != nil {
 		s += len(r.URL.String())
@@ -35,15 +150,709 @@ func computeApproximateRequestSize(r *http.Request) int {
 
 	// N.B. r.Form and r.MultipartForm are assumed to be included in r.URL.
 
-	if r.ContentLength != -1 {
+	if includeBody && r.ContentLength != -1 {
 		s += int(r.ContentLength)
 	}
 	return s
 }
 
+// isWebSocketUpgrade tells whether r asks to upgrade the connection to a
+// WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerContainsToken reports whether any comma-separated element of the
+// named header equals token, ignoring case.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, elem := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(elem), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contentLengthMismatch tells whether the response declared a Content-Length
+// other than the number of bytes actually written. Responses which carry no
+// body by definition are never considered mismatched.
+func contentLengthMismatch(r *http.Request, wrec caddyhttp.ResponseRecorder) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	switch status := wrec.Status(); {
+	case status == http.StatusNoContent, status == http.StatusNotModified, status < 200:
+		return false
+	}
+	cl := wrec.Header().Get("Content-Length")
+	if cl == "" {
+		return false
+	}
+	declared, err := strconv.Atoi(cl)
+	if err != nil {
+		return true
+	}
+	return declared != wrec.Size()
+}
+
+// retryAfter returns the delay a Retry-After header asks for, given either
+// as a number of seconds or as an HTTP date.
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	v := strings.TrimSpace(header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// responseAge returns the age in seconds a response reports in the given
+// header.
+func responseAge(header http.Header, name string) (float64, bool) {
+	age, err := strconv.ParseFloat(strings.TrimSpace(header.Get(name)), 64)
+	if err != nil || age < 0 || math.IsInf(age, 0) || math.IsNaN(age) {
+		return 0, false
+	}
+	return age, true
+}
+
+// responseTrailers tells whether a response declared or set trailers, and
+// returns the value of its grpc-status, if any. Trailers are only complete
+// once the handler chain has returned.
+func responseTrailers(header http.Header) (hasTrailers bool, grpcStatus string) {
+	for name := range header {
+		if name == "Trailer" || strings.HasPrefix(name, http.TrailerPrefix) {
+			hasTrailers = true
+			break
+		}
+	}
+	grpcStatus = header.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	return hasTrailers, grpcStatus
+}
+
 // Gizmo is an example; put your own type here.
 type CaddyMetrics struct {
-	logger *zap.Logger
+	// Disables the Prometheus collectors, for when another sink is the
+	// only consumer of the observations. With `otlp` the collectors are
+	// kept, but only fed to the OTLP exporter.
+	DisablePrometheus bool `json:"disable_prometheus,omitempty"`
+
+	// When set, no collectors are registered; instead the distinct values
+	// of each label of the code-labeled metrics are counted and logged once
+	// per this window, to preview the cardinality of a label config before
+	// rolling it out. A diagnostic mode.
+	DryRun caddy.Duration `json:"dry_run,omitempty"`
+
+	// The registry the collectors are registered into: `default`, `caddy`
+	// or `custom:<name>`. Custom registries can be served with the
+	// `extend_metrics_exporter` handler. Default: `default`.
+	Registry string `json:"registry,omitempty"`
+
+	// Registers the collectors into each of these registries instead of
+	// the single one of `registry`, such as while migrating scrapers from
+	// one to the other. Every observation shows in all of them; `listen`
+	// and `otlp` use the first.
+	Registries []string `json:"registries,omitempty"`
+
+	// Const labels to add to some of the metrics only, by metric name
+	// without the `caddy_http_extend_` prefix, such as an `slo_tier` on
+	// `request_duration_seconds` for recording rules to select on. They
+	// must not collide with the labels of the metric.
+	ConstLabelsFor map[string]map[string]string `json:"const_labels_for,omitempty"`
+
+	// Leaves the body out of `request_size_bytes`, which then only covers
+	// the request line, headers and host.
+	RequestSizeHeadersOnly bool `json:"request_size_headers_only,omitempty"`
+
+	// Requests completing faster than this are counted in
+	// `requests_below_duration_threshold_total` rather than observed in the
+	// round-trip duration histogram, so that instant responders such as
+	// `respond` don't crowd its lowest buckets. Default: 0 (observe all).
+	MinDurationThreshold caddy.Duration `json:"min_duration_threshold,omitempty"`
+
+	// Responses whose first byte comes faster than this are counted in
+	// `responses_below_ttfb_threshold_total` rather than observed in the
+	// time to first byte histogram, such as cache hits. Default: 0
+	// (observe all).
+	MinTTFBThreshold caddy.Duration `json:"min_ttfb_threshold,omitempty"`
+
+	// Responses with fewer body bytes than this are counted in
+	// `small_responses_total` rather than observed in the response size
+	// histogram, to focus it on meaningful payloads. Default: 0 (observe all).
+	MinResponseSize int64 `json:"min_response_size,omitempty"`
+
+	// Rounds the round-trip durations and times to first byte to a multiple
+	// of this before observing them, such as 1ms. Unless the resolution
+	// approaches the width of the lowest buckets the histograms are hardly
+	// affected, as observations only move to a neighbouring bucket when
+	// within half the resolution of a boundary. Default: 0 (no rounding).
+	DurationResolution caddy.Duration `json:"duration_resolution,omitempty"`
+
+	// Dynamic label values (such as the host) longer than this many bytes
+	// are truncated and suffixed with a hash of the full value. A negative
+	// value, or 0 in the Caddyfile, disables truncation. Default: 512.
+	MaxLabelLength int `json:"max_label_length,omitempty"`
+
+	// When set, only requests to hosts matching one of these patterns are
+	// observed individually. In patterns `*` matches any sequence of
+	// characters, such as in `*.example.com`.
+	HostAllowlist []string `json:"host_allowlist,omitempty"`
+
+	// Requests to hosts matching one of these patterns are not observed
+	// individually.
+	HostBlocklist []string `json:"host_blocklist,omitempty"`
+
+	// What happens with requests to hosts left out by the allowlist or
+	// blocklist: `collapse` reports them with a host label of `other`,
+	// `skip` passes them through unobserved. Default: `collapse`.
+	OtherHosts string `json:"other_hosts,omitempty"`
+
+	// What happens with hosts too long to be valid or holding characters no
+	// host has, such as control characters: `bucket` reports them with a
+	// host label of `invalid`, `sanitize` strips these characters and
+	// truncates them, and `passthrough` keeps them as they are. This guards
+	// the host label against injection via the Host header. Default:
+	// `bucket`.
+	InvalidHostHandling string `json:"invalid_host_handling,omitempty"`
+
+	// The names of the host, code and method labels. They can't take the
+	// name of another label, nor `le`, `quantile` or the fixed labels of
+	// other metrics, such as `reason`. Default: `host`, `code` and `method`.
+	HostLabelName   string `json:"host_label_name,omitempty"`
+	CodeLabelName   string `json:"code_label_name,omitempty"`
+	MethodLabelName string `json:"method_label_name,omitempty"`
+
+	// Rewrites the host label of matching hosts, trying each group in
+	// order, to keep the cardinality of wildcard domains in check.
+	HostGroups []HostGroup `json:"host_groups,omitempty"`
+
+	// When set, the host label of hosts matching none of the host groups
+	// is replaced with this value. Default: the host is kept as is.
+	HostGroupFallback string `json:"host_group_fallback,omitempty"`
+
+	// Whether requests excluded by path or sampling still count towards
+	// `requests_in_flight`. Default: true.
+	InFlightIncludesExcluded *bool `json:"in_flight_includes_excluded,omitempty"`
+
+	// When set, `requests_in_flight_max` reports the highest number of
+	// concurrent requests reached during each window of this length. The
+	// handlers sharing a registry share the mark, taken over their combined
+	// concurrency as in `requests_in_flight`.
+	InFlightMaxWindow caddy.Duration `json:"in_flight_max_window,omitempty"`
+
+	// Exposes the number of goroutines of the process, sampled when
+	// scraped, as `process_goroutines` next to `requests_in_flight`, to
+	// correlate goroutine growth with concurrency. It duplicates
+	// `go_goroutines` of the Go collector, which custom registries lack.
+	ProcessGoroutines bool `json:"process_goroutines,omitempty"`
+
+	// When set, at most this many requests go through the handler at once;
+	// the others queue for a slot, their wait observed in
+	// `concurrency_wait_seconds`. WebSocket connections are not limited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// How long requests queue for a slot before being rejected with a 503,
+	// counted in `concurrency_rejections_total`. Default: 0, queuing for as
+	// long as the client waits.
+	MaxConcurrentWait caddy.Duration `json:"max_concurrent_wait,omitempty"`
+
+	// When set, `requests_in_flight_by_path_prefix` breaks the requests in
+	// flight down by the longest of these prefixes their path starts with;
+	// requests matching none are labeled `other`.
+	InFlightPathPrefixes []string `json:"in_flight_path_prefixes,omitempty"`
+
+	// When set, only these status codes are tracked individually in the
+	// code label; any other code is reported as `other`.
+	CommonCodes []int `json:"common_codes,omitempty"`
+
+	// Which method labels the code-labeled metrics carry: `method` (the
+	// sanitized method), `method_class` (`safe`, `idempotent`, `unsafe` or
+	// `other`) or `both`. Default: `method`.
+	MethodLabels string `json:"method_labels,omitempty"`
+
+	// The case of the method and effective_method label values: `upper`,
+	// `lower`, such as for dashboards standardized on lowercase values, or
+	// `preserve`, which keeps the uppercase sanitized methods, `OTHER`
+	// included. Default: `preserve`.
+	LabelValueCase string `json:"label_value_case,omitempty"`
+
+	// When set, adds an `effective_method` label holding the method a POST
+	// request tunnels through this header, such as
+	// `X-HTTP-Method-Override`, or else the request's own method. The
+	// `method` label keeps the method as sent.
+	EffectiveMethodHeader string `json:"effective_method_header,omitempty"`
+
+	// Adds a `host_sni_match` label telling whether the TLS server name
+	// matches the host (`true` or `false`), which may reveal domain
+	// fronting. Plaintext requests and clients sending no server name are
+	// labeled `n/a`.
+	HostSNIMatchLabel bool `json:"host_sni_match_label,omitempty"`
+
+	// Adds an `authority_host_match` label telling whether the `:authority`
+	// pseudo-header of HTTP/2 and HTTP/3 requests matches their `Host`
+	// header (`true` or `false`), which may reveal misbehaving clients or
+	// request smuggling attempts. Requests without both are labeled `n/a`,
+	// which includes every HTTP/1 request: Go moves their Host header into
+	// the request's host, so there is nothing to compare it with.
+	AuthorityHostMatchLabel bool `json:"authority_host_match_label,omitempty"`
+
+	// When set, adds an `origin` label telling whether the client IP is in
+	// one of these CIDR ranges (`internal`) or not (`external`). The
+	// client IP is the one Caddy derives, honoring trusted proxies.
+	InternalCIDRs []string `json:"internal_cidrs,omitempty"`
+
+	// Adds a `transport` label telling whether requests arrived over `tcp`
+	// or `quic`, or `unknown` when neither, such as over a unix socket.
+	TransportLabel bool `json:"transport_label,omitempty"`
+
+	// Adds an `accept_encoding` label holding the compressed encoding the
+	// client accepts among `br`, `gzip` and `zstd`, or `multiple`, `other`
+	// when it only accepts other encodings, `identity` when it accepts no
+	// compression, or `none` without an Accept-Encoding header, to inform
+	// the choice of compression.
+	AcceptEncodingLabel bool `json:"accept_encoding_label,omitempty"`
+
+	// Adds a `has_body` label telling whether requests come with a body
+	// (`true` or `false`), to tell whether payloads slow them down. This
+	// doubles the number of series of the code-labeled metrics.
+	HasBodyLabel bool `json:"has_body_label,omitempty"`
+
+	// Adds an `alpn` label holding the protocol negotiated with ALPN for the
+	// connection: `h2`, `http/1.1`, `h3` or `other`, or `none` for plaintext
+	// requests and clients which negotiated none. Unlike the protocol of
+	// the request, this tells what the TLS layer agreed on.
+	ALPNLabel bool `json:"alpn_label,omitempty"`
+
+	// When set, adds a `service` label resolved from this template of
+	// placeholders for each request, such as
+	// `{http.request.host}/{http.request.uri.path.0}`. Placeholders are
+	// resolved synchronously: Caddy's replacer and vars aren't safe for
+	// concurrent use, so a resolution can't be abandoned on a timeout and
+	// slow placeholders delay the request.
+	ServiceLabel string `json:"service_label,omitempty"`
+
+	// How many distinct values the service label may take; later ones are
+	// reported as `other`. Default: 100.
+	ServiceLabelMaxValues int `json:"service_label_max_values,omitempty"`
+
+	// The value of the service label when the template resolves to an
+	// empty string. Default: empty.
+	ServiceLabelDefault string `json:"service_label_default,omitempty"`
+
+	// When set, adds a `route_id` label with this value, such as the `@id`
+	// of the route the handler is placed in. Caddy strips `@id` fields from
+	// the config before loading modules and records no matched route in the
+	// request context, so the ID can't be picked up automatically.
+	RouteID string `json:"route_id,omitempty"`
+
+	// Adds a `path` label holding the leading segments of the request path,
+	// as rewritten by the handlers upstream of this one, if any.
+	PathLabel *PathLabel `json:"path_label,omitempty"`
+
+	// Adds an `orig_path` label holding the leading segments of the request
+	// path as the client sent it, before any rewrite.
+	OrigPathLabel *PathLabel `json:"orig_path_label,omitempty"`
+
+	// Adds a label for each of these request variables, such as set by the
+	// vars handler or a matcher upstream of this one, to classify requests.
+	VarLabels []*VarLabel `json:"var_labels,omitempty"`
+
+	// When set, adds a `cert_issuer` label mapping the issuer common name of
+	// the certificate served to TLS requests to one of these values; other
+	// issuers are labeled `other`, plaintext requests `none`. As with
+	// `tls_cert_expiry`, the certificate must be stored in the connection
+	// context under ServingCertificateCtxKey, or else requests are labeled
+	// `unknown`.
+	CertIssuers map[string]string `json:"cert_issuers,omitempty"`
+
+	// Adds a `cookie_<name>` label for each of these cookie names, telling
+	// whether the request carried the cookie (`true` or `false`), such as
+	// to tell logged-in from anonymous traffic.
+	CookiePresenceLabels []string `json:"cookie_presence_labels,omitempty"`
+
+	// When set, adds a `size_class` label to the metrics observed once the
+	// response is complete, classifying the response size as `tiny`,
+	// `small`, `medium`, `large` or `huge`. The four values are the upper
+	// bounds in bytes of the first four classes.
+	SizeClasses []int64 `json:"size_classes,omitempty"`
+
+	// Adds an `auth` label classifying requests by authentication outcome.
+	AuthLabel *AuthLabel `json:"auth_label,omitempty"`
+
+	// When set, only requests matching at least one of these matcher sets
+	// are observed; the others pass straight through.
+	MatchRaw caddyhttp.RawMatcherSets `json:"match,omitempty" caddy:"namespace=http.matchers"`
+
+	// Requests whose path starts with one of these prefixes pass through
+	// without being observed.
+	ExcludePaths []string `json:"exclude_paths,omitempty"`
+
+	// Responses with one of these status codes are left out of the
+	// code-labeled histograms.
+	ExcludeCodes []int `json:"exclude_codes,omitempty"`
+
+	// Requests with one of these methods are also observed in
+	// `write_request_duration_seconds`, a focused histogram of the latency
+	// of mutating operations. In the Caddyfile, `write_methods` without
+	// arguments stands for the unsafe methods: POST, PUT, PATCH and DELETE.
+	WriteMethods []string `json:"write_methods,omitempty"`
+
+	// Responses to requests with one of these methods, such as HEAD and
+	// OPTIONS which rarely have a body, are left out of the response size
+	// histogram only, so as not to skew its lowest buckets.
+	ResponseSizeExcludeMethods []string `json:"response_size_exclude_methods,omitempty"`
+
+	// Fraction of requests to observe, between 0 and 1. Requests that are
+	// not sampled pass through without being observed. Default: 1.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// Fraction of requests observed in `request_duration_seconds`,
+	// `response_duration_seconds`, `request_size_bytes` and
+	// `response_size_bytes`, between 0 and 1, which makes them cheaper
+	// while counters stay exact: every request is still counted, by code
+	// in `responses_total`. The other histograms, such as
+	// `server_duration_seconds`, `request_duration_fast_seconds`,
+	// `request_duration_slow_seconds`, `error_response_duration_seconds`
+	// and `write_request_duration_seconds`, observe every request. The
+	// rate is exposed as `histogram_sample_rate` by host, to join with the
+	// sampled histograms. Quantiles computed from the sampled buckets are
+	// unbiased; divide their counts and sums by the rate to estimate the
+	// actual ones. Default: 1.
+	HistogramSampleRate float64 `json:"histogram_sample_rate,omitempty"`
+
+	// Logs one structured entry per observed request carrying the values the
+	// metrics are made of, for pipelines deriving metrics from logs. Combine
+	// with `disable_prometheus` to only log.
+	LogMetrics bool `json:"log_metrics,omitempty"`
+
+	// When set, keeps the last this many observed requests in memory,
+	// served as JSON by the admin endpoint at
+	// `/extend_metrics/recent_requests` for ad-hoc troubleshooting. The
+	// buffer is shared by all handlers and sized for the largest of them.
+	RecentRequests int `json:"recent_requests,omitempty"`
+
+	// Lets the admin endpoint at `/extend_metrics/delete` delete the series
+	// of this handler matching the label values given as query parameters,
+	// such as `POST /extend_metrics/delete?host=evil.example.com`, to clean
+	// up junk series without restarting Caddy.
+	EnableAdmin bool `json:"enable_admin,omitempty"`
+
+	// Measures the time requests spend between this handler and the next
+	// `extend_metrics` handler down the chain, such as the time spent
+	// waiting in a rate or concurrency limiter placed between the two, as
+	// `queue_wait_seconds`. Caddy records no enqueue time of its own, so
+	// the measurement starts when this handler is entered and ends when the
+	// inner handler is entered; without an inner handler nothing is
+	// observed.
+	QueueWait bool `json:"queue_wait,omitempty"`
+
+	// Observes the time between consecutive requests to each host as
+	// `request_interarrival_seconds`, telling bursty traffic from steady
+	// traffic. This keeps the last arrival time of every host.
+	Interarrival bool `json:"interarrival,omitempty"`
+
+	// Observes the number of query parameters of each request as
+	// `request_query_param_count`, flagging unexpectedly complex queries.
+	// Parameters are counted from the raw query without parsing it, so a
+	// repeated key counts once per occurrence.
+	QueryParamCount bool `json:"query_param_count,omitempty"`
+
+	// Observes the deepest nesting of `extend_metrics` handlers each
+	// request reached as `handler_chain_depth`, counting this one. Caddy
+	// doesn't count the handlers a request traverses, so other handlers
+	// don't add to the depth; place instances at the points of interest of
+	// a route tree. Only the outermost instance observes.
+	ChainDepth bool `json:"chain_depth,omitempty"`
+
+	// Whether requests failing with an error other than a handler error
+	// are still observed in the code-labeled histograms, with a code of
+	// 500 unless a response was already written. Handler errors are always
+	// observed with their status code. Either way the error is counted in
+	// `request_errors_total`. Default: false.
+	ObserveErrors bool `json:"observe_errors,omitempty"`
+
+	// Also observes the round-trip duration of 4xx and 5xx responses in
+	// `error_response_duration_seconds`, keeping the latency of errors
+	// visible apart from the bulk of successful requests.
+	ErrorResponseDuration bool `json:"error_response_duration,omitempty"`
+
+	// When set, request bodies larger than this many bytes are rejected
+	// with a 413 error, as with the request_body handler. Rejections by
+	// either are counted in `body_limit_exceeded_total`, provided the
+	// handler chain returns the error.
+	BodyLimitBytes int64 `json:"body_limit_bytes,omitempty"`
+
+	// Observes the time spent blocked reading request bodies as
+	// `request_body_read_seconds`, isolating slow uploads from processing
+	// time. Requests whose body is never read are not observed. This wraps
+	// the body of every request.
+	BodyReadDuration bool `json:"body_read_duration,omitempty"`
+
+	// Observes the throughput of request body reads as
+	// `request_ingress_bytes_per_second`, the bytes read over the time
+	// spent blocked reading them, to spot slow clients. Bodies which are
+	// never read, empty or read without blocking are not observed. This
+	// wraps the body of every request, as with `body_read_duration`.
+	BodyIngressRate bool `json:"body_ingress_rate,omitempty"`
+
+	// Counts responses carrying trailers in `responses_with_trailers_total`
+	// and gRPC responses by their grpc-status in `grpc_status_total`.
+	Trailers bool `json:"trailers,omitempty"`
+
+	// Observes the total length of the values of these request headers,
+	// such as `Authorization`, as `request_header_size_bytes`, to catch
+	// oversized tokens. Requests without the header are not observed.
+	HeaderSizeMetrics []string `json:"header_size_metrics,omitempty"`
+
+	// When set, observes the compression ratio of encoded responses as
+	// `response_compression_ratio`, their uncompressed size over the size
+	// written. Caddy's encode handler doesn't expose the uncompressed size,
+	// so it is read from this response header, which a handler inside the
+	// encode handler must set to the length of the body; the handler goes
+	// outside of encode. Responses without a Content-Encoding or a valid
+	// header value are not observed.
+	CompressionRatioHeader string `json:"compression_ratio_header,omitempty"`
+
+	// Observes the time from accepting a connection until its first
+	// request reaches this handler as `accept_to_handler_seconds`, which
+	// includes reading the request headers. The accept time must be stored
+	// in the connection context, see ConnAccept.
+	AcceptToHandler bool `json:"accept_to_handler,omitempty"`
+
+	// Observes the number of each request on its connection, starting at
+	// 1, as `connection_request_number`; many first requests indicate poor
+	// keep-alive reuse. Requests whose connection is unknown are not
+	// observed.
+	ConnectionRequests bool `json:"connection_requests,omitempty"`
+
+	// Observes how many requests are in flight on the connection of each
+	// HTTP/2 request, itself included, as `h2_concurrent_streams`. Caddy
+	// doesn't expose the streams of its HTTP/2 server to handlers, so only
+	// the requests going through this handler are counted, and nothing is
+	// observed for other protocols.
+	H2ConcurrentStreams bool `json:"h2_concurrent_streams,omitempty"`
+
+	// Counts 5xx responses by a class derived from their body in
+	// `error_body_class_total`. See ErrorBodyClass.
+	ErrorBodyClass *ErrorBodyClass `json:"error_body_class,omitempty"`
+
+	// Emits events to Caddy's events app for slow requests and errors, so
+	// other modules can react to them. See Events.
+	Events *Events `json:"events,omitempty"`
+
+	// Starts an OpenTelemetry span around the rest of the handler chain for
+	// requests not already traced, named by the method and the first two
+	// path segments and carrying the labels as attributes. Spans come from
+	// the global tracer provider, as Caddy's tracing handler doesn't share
+	// its own, so nothing is recorded unless a plugin installs one.
+	Tracing bool `json:"tracing,omitempty"`
+
+	// Observes the time spent writing buffered responses out to the client
+	// as `response_buffer_flush_seconds`, the cost of buffering them on top
+	// of streaming. Responses are only buffered for error_body_class, so
+	// nothing is observed without it.
+	BufferFlushDuration bool `json:"buffer_flush_duration,omitempty"`
+
+	// Tracks the responses currently held in memory by the handler in
+	// `requests_buffering_in_flight`, from the decision to buffer them
+	// until they are written out. Like buffer_flush_duration, this only
+	// reports anything along with error_body_class.
+	BufferingInFlight bool `json:"buffering_in_flight,omitempty"`
+
+	// Observes the number of times each response was flushed as
+	// `response_flush_count`, the granularity of streamed responses such
+	// as server-sent events. This wraps the response writer.
+	FlushCount bool `json:"flush_count,omitempty"`
+
+	// Counts the requests completing without their header write reaching
+	// this handler in `ttfb_fallback_total`, such as when handlers write
+	// nothing or bypass the response writer. Their code is set afterwards
+	// and their time to first byte isn't observed, so a high rate makes
+	// `response_duration_seconds` unreliable.
+	TTFBFallback bool `json:"ttfb_fallback,omitempty"`
+
+	// Counts the requests aborted without a response, such as by Caddy's
+	// `abort` directive, in `requests_aborted_total`. They are counted in
+	// `requests_total` too, but having no status code they are left out of
+	// the code-labeled metrics and of `request_errors_total`.
+	Aborts bool `json:"aborts,omitempty"`
+
+	// Observes the time from the start of the request to the first byte of
+	// the response as `server_duration_seconds`, the processing time of the
+	// server regardless of how fast clients read the body. Unlike the time
+	// to first byte it carries the same labels as the round-trip duration,
+	// and requests writing no response are observed with their round-trip
+	// duration.
+	ServerDuration bool `json:"server_duration,omitempty"`
+
+	// Counts the responses which failed to be written out, typically as the
+	// client went away partway through, in `response_write_errors_total`
+	// by host and code. Unlike request_errors_total, this doesn't depend on
+	// the handler returning an error. This wraps the response writer.
+	ResponseWriteErrors bool `json:"response_write_errors,omitempty"`
+
+	// Observes the delay the Retry-After header of 429 and 503 responses
+	// asks for as `retry_after_seconds`, revealing how aggressively
+	// backpressure is applied. Responses without the header are not
+	// observed.
+	RetryAfter bool `json:"retry_after,omitempty"`
+
+	// When set, observes the age in seconds responses report in this
+	// header, such as `Age` or `X-Cache-Age`, as `response_age_seconds`,
+	// revealing how stale cache hits are. Responses without the header or
+	// with a non-numeric age are not observed.
+	AgeHeader string `json:"age_header,omitempty"`
+
+	// Counts 304 Not Modified responses in `revalidations_total` and
+	// leaves them out of `response_size_bytes`, as they carry no body.
+	Revalidations bool `json:"revalidations,omitempty"`
+
+	// Reports the seconds until the certificate served to TLS requests
+	// expires as `tls_cert_expiry_seconds`, updated on every request.
+	// On the server side Go's TLS connection state only carries the
+	// client's certificates, so the served one must be stored in the
+	// connection context under ServingCertificateCtxKey, by a custom
+	// listener or ConnContext hook; without it nothing is reported.
+	TLSCertExpiry bool `json:"tls_cert_expiry,omitempty"`
+
+	// Counts responses whose declared Content-Length differs from the
+	// number of bytes written in `content_length_mismatch_total`.
+	ContentLengthMismatch bool `json:"content_length_mismatch,omitempty"`
+
+	// Observes how many response header fields the rest of the handler
+	// chain added (or removed, as negative values) as
+	// `response_header_delta`, a rough signal of header manipulation.
+	HeaderDelta bool `json:"header_delta,omitempty"`
+
+	// Observes the number of Set-Cookie header fields of each response as
+	// `response_set_cookie_count`, to catch handlers setting too many
+	// cookies.
+	SetCookieCount bool `json:"set_cookie_count,omitempty"`
+
+	// Exposes the round-trip duration, time to first byte and size
+	// histograms as summaries without quantiles, which only carry the
+	// `_count` and `_sum` series. Averages can still be computed, at a
+	// fraction of the series. Default: false.
+	SummaryOnly bool `json:"summary_only,omitempty"`
+
+	// Buckets of the duration histograms, in seconds.
+	// Default: the Prometheus default buckets.
+	DurationBuckets []float64 `json:"duration_buckets,omitempty"`
+
+	// Overrides the buckets of the round-trip duration and time to first
+	// byte histograms for the hosts matching one of these, the first match
+	// winning. The series of these hosts carry their own `le` values, so
+	// aggregating buckets across hosts only makes sense within a bucket
+	// set.
+	HostBuckets []HostBuckets `json:"host_buckets,omitempty"`
+
+	// Buckets of the size histograms, in bytes.
+	// Default: 8 exponential buckets from 256 bytes by a factor of 4.
+	SizeBuckets []float64 `json:"size_buckets,omitempty"`
+
+	// Buckets of the optional `request_duration_fast_seconds` histogram,
+	// observed alongside the default duration histogram.
+	DurationFastBuckets []float64 `json:"duration_fast_buckets,omitempty"`
+
+	// Buckets of the optional `request_duration_slow_seconds` histogram,
+	// observed alongside the default duration histogram.
+	DurationSlowBuckets []float64 `json:"duration_slow_buckets,omitempty"`
+
+	// Fraction of the requests counted in `request_errors_total` which are
+	// logged with their request ID. Default: 0 (none).
+	LogErrorsSampleRate float64 `json:"log_errors_sample_rate,omitempty"`
+
+	// When set, serves the registry on a dedicated listener at this
+	// address, which may be a TCP address or a unix socket such as
+	// `unix//run/caddy-metrics.sock`.
+	Listen string `json:"listen,omitempty"`
+
+	// When set, reports `handler_up` as 1 while the handler is provisioned,
+	// with this value as its `name` label alongside the Caddy version.
+	HandlerUp string `json:"handler_up,omitempty"`
+
+	// Reports `config_info` with a `hash` label identifying the config of
+	// the handler, to correlate metric changes with deploys. Caddy doesn't
+	// expose the config being loaded to modules, so the hash only covers
+	// the handler's own config, as resolved from the Caddyfile.
+	ConfigInfo bool `json:"config_info,omitempty"`
+
+	// Reports `histogram_bucket_config` with a series per bucket of each
+	// configurable histogram, by `metric` and `le`, to check the buckets in
+	// effect against dashboards. The host_buckets overrides are left out.
+	BucketConfigInfo bool `json:"bucket_config_info,omitempty"`
+
+	// Optionally sends the observations to a StatsD daemon as well.
+	StatsD *StatsD `json:"statsd,omitempty"`
+
+	// Modules called with the outcome of every observed request, from the
+	// `http.extend_metrics.observers` namespace. See RequestObserver.
+	ObserversRaw []json.RawMessage `json:"observers,omitempty" caddy:"namespace=http.extend_metrics.observers inline_key=observer"`
+
+	// Optionally pushes the metrics to an OpenTelemetry collector over
+	// OTLP, alongside or, with `disable_prometheus`, instead of serving
+	// them to Prometheus.
+	OTLP *OTLP `json:"otlp,omitempty"`
+
+	// OnObserve, when set, is called like the observers with the outcome of
+	// every observed request, such as for programs embedding the handler
+	// to assert on exact values in their tests.
+	OnObserve func(stats RequestStats) `json:"-"`
+
+	// Clock is the time source durations are measured with. Programs
+	// embedding the handler may set it before provisioning.
+	// Default: the system clock.
+	Clock Clock `json:"-"`
+
+	clock          Clock
+	hostKey        string
+	codeKey        string
+	methodKey      string
+	logger         *zap.Logger
+	metrics        *metrics
+	statsd         *statsdClient
+	events         *eventEmitter
+	tracer         trace.Tracer
+	otlp           *otlpExporter
+	errorBodies    *errorBodyClassifier
+	dryRun         *dryRun
+	services       *boundedSet
+	observers      []RequestObserver
+	startObservers []RequestStartObserver
+	excludedCodes  map[string]struct{}
+	writeMethods   map[string]struct{}
+	sizeMethods    map[string]struct{}
+	internalNets   []netip.Prefix
+	commonCodes    map[string]struct{}
+	inFlightMax    *inFlightMax
+	inFlightDown   func()
+	slots          chan struct{}
+	connRequests   *connRequests
+	interarrivals  *interarrivals
+	server         *metricsServer
+	handlerDown    func()
+	configDown     func()
+	sampleRates    *liveHostSeries
+	bucketsDown    []func()
+	match          caddyhttp.MatcherSets
 }
 
 // CaddyModule returns the Caddy module information.
@@ -54,69 +863,2175 @@ func (CaddyMetrics) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-func (c *CaddyMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	labels := prometheus.Labels{"host": r.Host}
-	method := SanitizeMethod(r.Method)
-	// the "code" value is set later, but initialized here to eliminate the possibility
-	// of a panic
-	statusLabels := prometheus.Labels{"host": r.Host, "method": method, "code": "0"}
+// Provision sets up the module.
+func (c *CaddyMetrics) Provision(ctx caddy.Context) error {
+	c.logger = ctx.Logger()
 
-	inFlight := httpMetrics.requestInFlight.With(labels)
-	inFlight.Inc()
-	defer inFlight.Dec()
+	var hash string
+	if c.ConfigInfo {
+		var err error
+		hash, err = configHash(c)
+		if err != nil {
+			return fmt.Errorf("hashing config: %v", err)
+		}
+	}
 
-	start := time.Now()
+	c.clock = c.Clock
+	if c.clock == nil {
+		c.clock = systemClock{}
+	}
 
-	// This is a _bit_ of a hack - it depends on the ShouldBufferFunc always
-	// being called when the headers are written.
-	// Effectively the same behaviour as promhttp.InstrumentHandlerTimeToWriteHeader.
-	writeHeaderRecorder := caddyhttp.ShouldBufferFunc(func(status int, header http.Header) bool {
-		statusLabels["code"] = SanitizeCode(status)
-		ttfb := time.Since(start).Seconds()
-		httpMetrics.responseDuration.With(statusLabels).Observe(ttfb)
-		return false
-	})
-	wrec := caddyhttp.NewResponseRecorder(w, nil, writeHeaderRecorder)
-	err := next.ServeHTTP(wrec, r)
-	dur := time.Since(start).Seconds()
-	httpMetrics.requestCount.With(labels).Inc()
+	if c.MaxLabelLength == 0 {
+		c.MaxLabelLength = defaultMaxLabelLength
+	}
+	switch c.OtherHosts {
+	case "", otherHostsCollapse, otherHostsSkip:
+	default:
+		return fmt.Errorf("unrecognized other_hosts: %s", c.OtherHosts)
+	}
+	switch c.InvalidHostHandling {
+	case "", invalidHostsBucket, invalidHostsSanitize, invalidHostsPassthrough:
+	default:
+		return fmt.Errorf("unrecognized invalid_host_handling: %s", c.InvalidHostHandling)
+	}
+	c.CompressionRatioHeader = http.CanonicalHeaderKey(c.CompressionRatioHeader)
+	for i, name := range c.HeaderSizeMetrics {
+		c.HeaderSizeMetrics[i] = http.CanonicalHeaderKey(name)
+	}
+	for _, patterns := range [][]string{c.HostAllowlist, c.HostBlocklist} {
+		for i, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid host pattern %s: %v", pattern, err)
+			}
+			patterns[i] = strings.ToLower(pattern)
+		}
+	}
+	for _, cidr := range c.InternalCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("parsing internal_cidrs: %v", err)
+		}
+		c.internalNets = append(c.internalNets, prefix.Masked())
+	}
 
-	observeRequest := func(status int) {
-		// If the code hasn't been set yet, and we didn't encounter an error, we're
-		// probably falling through with an empty handler.
-		if statusLabels["code"] == "" {
-			// we still sanitize it, even though it's likely to be 0. A 200 is
-			// returned on fallthrough so we want to reflect that.
-			statusLabels["code"] = SanitizeCode(status)
+	for i := range c.HostGroups {
+		if err := c.HostGroups[i].compile(); err != nil {
+			return err
+		}
+	}
+	if c.LogErrorsSampleRate < 0 || c.LogErrorsSampleRate > 1 {
+		return fmt.Errorf("log_errors sample rate must be between 0 and 1: %v", c.LogErrorsSampleRate)
+	}
+
+	if c.MatchRaw != nil {
+		matcherSets, err := ctx.LoadModule(c, "MatchRaw")
+		if err != nil {
+			return fmt.Errorf("loading matchers: %v", err)
+		}
+		if err := c.match.FromInterface(matcherSets); err != nil {
+			return err
 		}
+	}
 
-		httpMetrics.requestDuration.With(statusLabels).Observe(dur)
-		httpMetrics.requestSize.With(statusLabels).Observe(float64(computeApproximateRequestSize(r)))
-		httpMetrics.responseSize.With(statusLabels).Observe(float64(wrec.Size()))
+	if c.ObserversRaw != nil {
+		mods, err := ctx.LoadModule(c, "ObserversRaw")
+		if err != nil {
+			return fmt.Errorf("loading observers: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			o, ok := mod.(RequestObserver)
+			if !ok {
+				return fmt.Errorf("module %T is not a RequestObserver", mod)
+			}
+			c.observers = append(c.observers, o)
+			if so, ok := mod.(RequestStartObserver); ok {
+				c.startObservers = append(c.startObservers, so)
+			}
+		}
 	}
 
-	if err != nil {
-		var handlerErr caddyhttp.HandlerError
-		if errors.As(err, &handlerErr) {
-			observeRequest(handlerErr.StatusCode)
+	if c.Registry != "" && len(c.Registries) > 0 {
+		return fmt.Errorf("registry and registries are mutually exclusive")
+	}
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1: %v", c.SampleRate)
+	}
+	if c.HistogramSampleRate < 0 || c.HistogramSampleRate > 1 {
+		return fmt.Errorf("histogram_sample_rate must be between 0 and 1: %v", c.HistogramSampleRate)
+	}
+
+	if len(c.ExcludeCodes) > 0 {
+		c.excludedCodes = make(map[string]struct{}, len(c.ExcludeCodes))
+		for _, code := range c.ExcludeCodes {
+			c.excludedCodes[SanitizeCode(code)] = struct{}{}
+		}
+	}
+	if len(c.WriteMethods) > 0 {
+		c.writeMethods = make(map[string]struct{}, len(c.WriteMethods))
+		for _, method := range c.WriteMethods {
+			c.writeMethods[strings.ToUpper(method)] = struct{}{}
+		}
+	}
+	if len(c.ResponseSizeExcludeMethods) > 0 {
+		c.sizeMethods = make(map[string]struct{}, len(c.ResponseSizeExcludeMethods))
+		for _, method := range c.ResponseSizeExcludeMethods {
+			c.sizeMethods[SanitizeMethod(strings.ToUpper(method))] = struct{}{}
+		}
+	}
+	if len(c.CommonCodes) > 0 {
+		c.commonCodes = make(map[string]struct{}, len(c.CommonCodes))
+		for _, code := range c.CommonCodes {
+			c.commonCodes[SanitizeCode(code)] = struct{}{}
+		}
+	}
+
+	switch c.MethodLabels {
+	case "", methodLabelsMethod, methodLabelsClass, methodLabelsBoth:
+	default:
+		return fmt.Errorf("unrecognized method_labels: %s", c.MethodLabels)
+	}
+	switch c.LabelValueCase {
+	case "", labelCasePreserve, labelCaseUpper, labelCaseLower:
+	default:
+		return fmt.Errorf("unrecognized label_value_case: %s", c.LabelValueCase)
+	}
+
+	if len(c.SizeClasses) > 0 {
+		if len(c.SizeClasses) != len(sizeClassNames)-1 {
+			return fmt.Errorf("size_classes requires %d thresholds, got %d", len(sizeClassNames)-1, len(c.SizeClasses))
+		}
+		for i := 1; i < len(c.SizeClasses); i++ {
+			if c.SizeClasses[i] <= c.SizeClasses[i-1] {
+				return fmt.Errorf("size_classes must be in strictly increasing order: %v", c.SizeClasses)
+			}
+		}
+	}
+
+	if c.AuthLabel != nil {
+		if err := c.AuthLabel.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range []*PathLabel{c.PathLabel, c.OrigPathLabel} {
+		if p != nil {
+			p.provision()
+		}
+	}
+
+	for _, v := range c.VarLabels {
+		if v.Var == "" {
+			return fmt.Errorf("var_label %s requires a variable name", v.Label)
 		}
+		max := v.MaxValues
+		if max <= 0 {
+			max = defaultVarLabelMaxValues
+		}
+		v.values = newBoundedSet(max)
+	}
 
-		httpMetrics.requestErrors.With(labels).Inc()
+	if c.ServiceLabel != "" {
+		max := c.ServiceLabelMaxValues
+		if max <= 0 {
+			max = defaultServiceLabelMaxValues
+		}
+		c.services = newBoundedSet(max)
+	}
 
+	if err := c.setLabelNames(); err != nil {
 		return err
 	}
 
-	observeRequest(wrec.Status())
+	if err := validateBuckets("duration_buckets", c.DurationBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("size_buckets", c.SizeBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("duration_fast_buckets", c.DurationFastBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("duration_slow_buckets", c.DurationSlowBuckets); err != nil {
+		return err
+	}
+	for _, hb := range c.HostBuckets {
+		if _, err := path.Match(hb.Host, ""); err != nil {
+			return fmt.Errorf("invalid host_buckets host %s: %v", hb.Host, err)
+		}
+		if len(hb.Buckets) == 0 {
+			return fmt.Errorf("host_buckets %s requires buckets", hb.Host)
+		}
+		if err := validateBuckets("host_buckets", hb.Buckets); err != nil {
+			return err
+		}
+	}
 
-	return nil
-}
+	if c.MaxConcurrent > 0 {
+		c.slots = make(chan struct{}, c.MaxConcurrent)
+	}
 
-func (c *CaddyMetrics) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.NextArg()
-	if d.NextArg() {
-		return d.ArgErr()
+	if c.RecentRequests > 0 {
+		recentRequests.grow(c.RecentRequests)
 	}
-	return nil
+
+	if c.DryRun > 0 {
+		c.dryRun = newDryRun(c.logger, time.Duration(c.DryRun))
+	} else if !c.DisablePrometheus || c.OTLP != nil {
+		var regs []prometheus.Registerer
+		var reg *registryRef
+		if c.DisablePrometheus {
+			// the collectors only feed the OTLP exporter
+			private := prometheus.NewRegistry()
+			reg = &registryRef{Registerer: private, Gatherer: private}
+			regs = append(regs, reg)
+		} else {
+			specs := c.Registries
+			if len(specs) == 0 {
+				specs = []string{c.Registry}
+			}
+			for _, spec := range specs {
+				ref, err := resolveRegistry(spec)
+				if err != nil {
+					return err
+				}
+				regs = append(regs, ref)
+			}
+			// the first registry is the one served by listen and
+			// exported over OTLP
+			reg = regs[0].(*registryRef)
+		}
+		var err error
+		c.metrics, err = newMetrics(regs, c, configID(ctx.Done()))
+		if err != nil {
+			return fmt.Errorf("registering metrics: %v", err)
+		}
+
+		if c.OTLP != nil {
+			c.otlp = newOTLPExporter(c.OTLP, reg, c.logger)
+		}
+
+		if c.Listen != "" && !c.DisablePrometheus {
+			c.server, err = startMetricsServer(ctx, c.Listen, reg, c.logger)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.HandlerUp != "" {
+			c.handlerDown = markHandlerUp(c.metrics.handlerUp, c.HandlerUp)
+		}
+
+		if c.ConfigInfo {
+			c.configDown = markLive(c.metrics.configInfo, prometheus.Labels{"hash": hash})
+		}
+
+		if c.metrics.histogramSampleRate != nil {
+			c.sampleRates = newLiveHostSeries(c.metrics.histogramSampleRate, c.hostKey, c.HistogramSampleRate)
+		}
+
+		if c.EnableAdmin {
+			adminHandlers.mu.Lock()
+			adminHandlers.handlers[c] = struct{}{}
+			adminHandlers.mu.Unlock()
+		}
+
+		if c.BucketConfigInfo {
+			for metric, buckets := range c.metrics.liveBuckets() {
+				for _, le := range buckets {
+					labels := prometheus.Labels{"metric": metric, "le": strconv.FormatFloat(le, 'g', -1, 64)}
+					c.bucketsDown = append(c.bucketsDown, markLive(c.metrics.bucketConfig, labels))
+				}
+			}
+		}
+
+		if c.ErrorBodyClass != nil {
+			c.errorBodies = newErrorBodyClassifier(c.ErrorBodyClass, c.metrics.errorBodyClass, c.hostKey, c.logger)
+		}
+
+		if c.Interarrival {
+			c.interarrivals = new(interarrivals)
+		}
+
+		if c.ConnectionRequests || c.H2ConcurrentStreams {
+			c.connRequests = newConnRequests(c.clock)
+		}
+
+		if c.InFlightMaxWindow > 0 {
+			c.inFlightMax, c.inFlightDown = acquireInFlightMax(c.metrics.requestInFlightMax, c.hostKey, time.Duration(c.InFlightMaxWindow))
+		}
+	}
+
+	if c.StatsD != nil {
+		client, err := newStatsDClient(c.StatsD, c.logger)
+		if err != nil {
+			return err
+		}
+		c.statsd = client
+	}
+
+	if c.Events != nil {
+		c.events = newEventEmitter(ctx, c.Events)
+	}
+	if c.Tracing {
+		c.tracer = newTracer()
+	}
+
+	return nil
+}
+
+// Cleanup releases the resources held by the module.
+func (c *CaddyMetrics) Cleanup() error {
+	adminHandlers.mu.Lock()
+	delete(adminHandlers.handlers, c)
+	adminHandlers.mu.Unlock()
+
+	if c.server != nil {
+		if err := c.server.stop(); err != nil {
+			c.logger.Error("stopping metrics server", zap.Error(err))
+		}
+	}
+	if c.handlerDown != nil {
+		c.handlerDown()
+	}
+	if c.configDown != nil {
+		c.configDown()
+	}
+	if c.sampleRates != nil {
+		c.sampleRates.down()
+	}
+	for _, down := range c.bucketsDown {
+		down()
+	}
+	if c.inFlightDown != nil {
+		c.inFlightDown()
+	}
+	if c.connRequests != nil {
+		c.connRequests.stop()
+	}
+	if c.otlp != nil {
+		c.otlp.stop()
+	}
+	if c.metrics != nil {
+		c.metrics.release()
+	}
+	if c.dryRun != nil {
+		c.dryRun.stop()
+	}
+	if c.statsd != nil {
+		return c.statsd.close()
+	}
+	return nil
+}
+
+// excludeReason tells whether a request should pass through unobserved,
+// and why.
+func (c *CaddyMetrics) excludeReason(r *http.Request) string {
+	if c.OtherHosts == otherHostsSkip && !c.hostAllowed(r) {
+		return excludedHost
+	}
+	for _, prefix := range c.ExcludePaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return excludedPath
+		}
+	}
+	if c.SampleRate > 0 && c.SampleRate < 1 && rand.Float64() >= c.SampleRate {
+		return excludedSampling
+	}
+	return ""
+}
+
+func (c *CaddyMetrics) codeExcluded(code string) bool {
+	_, ok := c.excludedCodes[code]
+	return ok
+}
+
+// collapseCode replaces codes outside of the common codes with "other",
+// when common codes are configured.
+func (c *CaddyMetrics) collapseCode(code string) string {
+	if c.commonCodes == nil {
+		return code
+	}
+	if _, ok := c.commonCodes[code]; ok {
+		return code
+	}
+	return otherCode
+}
+
+func (c *CaddyMetrics) countExcluded(host, reason string) {
+	if c.metrics != nil {
+		c.metrics.requestsExcluded.With(prometheus.Labels{c.hostKey: host, "reason": reason}).Inc()
+	}
+}
+
+func (c *CaddyMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if mark, ok := r.Context().Value(queueWaitCtxKey).(*queueMark); ok {
+		mark.reached()
+	}
+	depth, nested := r.Context().Value(chainDepthCtxKey).(*chainDepth)
+	if nested {
+		depth.enter()
+		defer depth.leave()
+	}
+
+	if c.match != nil && !c.match.AnyMatch(r) {
+		return next.ServeHTTP(w, r)
+	}
+
+	host := c.hostLabel(r)
+
+	if c.slots != nil && !isWebSocketUpgrade(r) {
+		release, err := c.acquireSlot(r, host)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	if reason := c.excludeReason(r); reason != "" {
+		c.countExcluded(host, reason)
+		if c.metrics != nil && (c.InFlightIncludesExcluded == nil || *c.InFlightIncludesExcluded) {
+			defer c.trackInFlight(host, r)()
+		}
+		return next.ServeHTTP(w, r)
+	}
+
+	if isWebSocketUpgrade(r) {
+		return c.serveWebSocket(w, r, next, host)
+	}
+
+	labels := prometheus.Labels{c.hostKey: host}
+	statusLabels := c.requestLabels(host, r)
+
+	if c.metrics != nil {
+		defer c.trackInFlight(host, r)()
+	}
+
+	start := c.clock.Now()
+
+	if c.interarrivals != nil {
+		if delta, ok := c.interarrivals.arrive(host, start); ok {
+			c.metrics.requestInterarrival.With(labels).Observe(delta.Seconds())
+		}
+	}
+	if c.metrics != nil && c.metrics.requestQueryParamCount != nil {
+		c.metrics.requestQueryParamCount.With(labels).Observe(float64(queryParamCount(r.URL.RawQuery)))
+	}
+
+	if c.QueueWait {
+		mark := &queueMark{clock: c.clock, start: start}
+		r = r.WithContext(context.WithValue(r.Context(), queueWaitCtxKey, mark))
+		defer func() {
+			if wait := mark.wait.Load(); wait > 0 && c.metrics != nil {
+				c.metrics.queueWait.With(labels).Observe(time.Duration(wait).Seconds())
+			}
+		}()
+	}
+
+	if c.ChainDepth && !nested {
+		depth = new(chainDepth)
+		depth.enter()
+		r = r.WithContext(context.WithValue(r.Context(), chainDepthCtxKey, depth))
+		defer func() {
+			if c.metrics != nil {
+				c.metrics.handlerChainDepth.With(labels).Observe(float64(depth.max.Load()))
+			}
+		}()
+	}
+
+	if r.TLS != nil && c.metrics != nil {
+		// Connections serve many requests, so only the first one to see the
+		// handshake observes it.
+		if hs, ok := r.Context().Value(TLSHandshakeCtxKey).(*TLSHandshake); ok && hs.observed.CompareAndSwap(false, true) {
+			c.metrics.tlsHandshakeDuration.With(labels).Observe(hs.Duration.Seconds())
+		}
+		if c.TLSCertExpiry {
+			if cert, ok := r.Context().Value(ServingCertificateCtxKey).(*x509.Certificate); ok {
+				c.metrics.tlsCertExpiry.With(labels).Set(cert.NotAfter.Sub(c.clock.Now()).Seconds())
+			}
+		}
+	}
+
+	if c.AcceptToHandler && c.metrics != nil {
+		if ca, ok := r.Context().Value(ConnAcceptCtxKey).(*ConnAccept); ok && !ca.Time.IsZero() && ca.observed.CompareAndSwap(false, true) {
+			c.metrics.acceptToHandler.With(labels).Observe(start.Sub(ca.Time).Seconds())
+		}
+	}
+
+	if c.connRequests != nil {
+		if c.ConnectionRequests {
+			if n, ok := c.connRequests.next(r); ok {
+				c.metrics.connectionRequestNumber.With(labels).Observe(float64(n))
+			}
+		}
+		if c.H2ConcurrentStreams {
+			if n, leave, ok := c.connRequests.enterStream(r); ok {
+				defer leave()
+				c.metrics.h2ConcurrentStreams.With(labels).Observe(float64(n))
+			}
+		}
+	}
+
+	if c.metrics != nil {
+		for _, name := range c.HeaderSizeMetrics {
+			if values, ok := r.Header[name]; ok {
+				size := 0
+				for _, value := range values {
+					size += len(value)
+				}
+				c.metrics.requestHeaderSize.With(prometheus.Labels{c.hostKey: host, "header": name}).Observe(float64(size))
+			}
+		}
+	}
+
+	// This is a _bit_ of a hack - it depends on the ShouldBufferFunc always
+	// being called when the headers are written.
+	// Effectively the same behaviour as promhttp.InstrumentHandlerTimeToWriteHeader.
+	sampled := c.histogramSampled()
+	if c.sampleRates != nil {
+		c.sampleRates.mark(host)
+	}
+	var headerAt time.Time
+	observeHeader := func(status int, header http.Header) {
+		if c.ServerDuration && headerAt.IsZero() {
+			headerAt = c.clock.Now()
+		}
+		statusLabels[c.codeKey] = SanitizeCode(status)
+		if c.codeExcluded(statusLabels[c.codeKey]) {
+			return
+		}
+		statusLabels[c.codeKey] = c.collapseCode(statusLabels[c.codeKey])
+		c.setResponseLabels(statusLabels, r, header, status)
+		elapsed := c.clock.Now().Sub(start)
+		ttfb := c.roundDuration(elapsed).Seconds()
+		belowThreshold := elapsed < time.Duration(c.MinTTFBThreshold)
+		if c.metrics != nil {
+			if belowThreshold {
+				c.metrics.responsesBelowTTFBThreshold.With(statusLabels).Inc()
+			} else if sampled {
+				c.metrics.responseDuration.With(statusLabels).Observe(ttfb)
+			}
+		}
+		if c.statsd != nil {
+			if belowThreshold {
+				c.statsd.count("responses_below_ttfb_threshold", statsdTags(statusLabels))
+			} else {
+				c.statsd.timing("response_duration", ttfb, statsdTags(statusLabels))
+			}
+		}
+	}
+	// the recorder reports a response as buffered until its header is
+	// written, so track the decision itself: a handler writing nothing
+	// leaves nothing to write out
+	var buffered bool
+	var buffering prometheus.Gauge
+	writeHeaderRecorder := caddyhttp.ShouldBufferFunc(func(status int, header http.Header) bool {
+		observeHeader(status, header)
+		buffered = c.shouldBuffer(status, header)
+		if buffered && c.metrics != nil {
+			c.metrics.responsesBuffered.With(labels).Inc()
+			if c.metrics.requestsBuffering != nil {
+				buffering = c.metrics.requestsBuffering.With(labels)
+				buffering.Inc()
+			}
+		}
+		return buffered
+	})
+	// the buffered response is written out right before returning, and
+	// nothing is if the chain panics
+	defer func() {
+		if buffering != nil {
+			buffering.Dec()
+		}
+	}()
+	var limited *limitedBody
+	if c.BodyLimitBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+		limited = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, c.BodyLimitBytes)}
+		r.Body = limited
+	}
+	var body *timedBody
+	if (c.BodyReadDuration || c.BodyIngressRate) && r.Body != nil && r.Body != http.NoBody {
+		body = &timedBody{ReadCloser: r.Body, clock: c.clock}
+		r.Body = body
+		defer func() {
+			if !body.read() || c.metrics == nil {
+				return
+			}
+			if c.BodyReadDuration {
+				c.metrics.requestBodyRead.With(labels).Observe(body.readDuration().Seconds())
+			}
+			if c.BodyIngressRate {
+				if rate, ok := body.rate(); ok {
+					c.metrics.requestIngressRate.With(labels).Observe(rate)
+				}
+			}
+		}()
+	}
+
+	headersBefore := len(w.Header())
+	var buf *bytes.Buffer
+	if c.errorBodies != nil {
+		buf = errorBodyBuffers.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer errorBodyBuffers.Put(buf)
+	}
+	if c.ResponseWriteErrors && c.metrics != nil {
+		writeErrs := &writeErrorRecorder{ResponseWriter: w}
+		w = writeErrs
+		// deferred to count the buffered responses written out last too
+		defer func() {
+			if writeErrs.failed.Load() {
+				code := c.collapseCode(SanitizeCode(int(writeErrs.status.Load())))
+				c.metrics.responseWriteErrors.With(prometheus.Labels{c.hostKey: host, c.codeKey: code}).Inc()
+			}
+		}()
+	}
+	var flusher *flushCounter
+	if c.FlushCount {
+		flusher = &flushCounter{ResponseWriter: w}
+		w = flusher
+	}
+	wrec := caddyhttp.NewResponseRecorder(w, buf, writeHeaderRecorder)
+	r, span := c.startSpan(r)
+	var err error
+	if span != nil {
+		// deferred right away so that the span also ends when the chain
+		// panics, including with http.ErrAbortHandler
+		defer func() {
+			if v := recover(); v != nil {
+				c.endSpan(span, statusLabels, panicError(v))
+				panic(v)
+			}
+			c.endSpan(span, statusLabels, err)
+		}()
+	}
+	for _, o := range c.startObservers {
+		o.RequestStarted(r)
+	}
+	if c.Aborts {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					c.countAborted(labels)
+				}
+				panic(v)
+			}
+		}()
+	}
+	err = next.ServeHTTP(wrec, r)
+	elapsed := c.clock.Now().Sub(start)
+	if c.metrics != nil && bodyLimitExceeded(limited, err) {
+		c.metrics.bodyLimitExceeded.With(labels).Inc()
+	}
+	if flusher != nil && c.metrics != nil {
+		c.metrics.responseFlushCount.With(labels).Observe(float64(flusher.flushes.Load()))
+	}
+	dur := c.roundDuration(elapsed).Seconds()
+	if len(c.observers) > 0 || c.OnObserve != nil {
+		c.notifyObservers(r, host, wrec, err, elapsed)
+	}
+	if c.metrics != nil {
+		c.metrics.requestCount.With(labels).Inc()
+	}
+	if c.statsd != nil {
+		c.statsd.count("requests", statsdTags(labels))
+	}
+
+	observeRequest := func(status int) {
+		// If the code hasn't been set yet, and we didn't encounter an error, we're
+		// probably falling through with an empty handler.
+		if statusLabels[c.codeKey] == "" {
+			// we still sanitize it, even though it's likely to be 0. A 200 is
+			// returned on fallthrough so we want to reflect that.
+			statusLabels[c.codeKey] = SanitizeCode(status)
+			if c.metrics != nil && c.metrics.ttfbFallback != nil {
+				c.metrics.ttfbFallback.With(labels).Inc()
+			}
+		}
+
+		if c.codeExcluded(statusLabels[c.codeKey]) {
+			c.countExcluded(host, excludedCode)
+			return
+		}
+		statusLabels[c.codeKey] = c.collapseCode(statusLabels[c.codeKey])
+		c.setResponseLabels(statusLabels, r, wrec.Header(), status)
+		if len(c.SizeClasses) > 0 {
+			statusLabels["size_class"] = sizeClass(int64(wrec.Size()), c.SizeClasses)
+		}
+
+		if c.dryRun != nil {
+			c.dryRun.record(statusLabels)
+		}
+
+		reqSize := float64(computeApproximateRequestSize(r, !c.RequestSizeHeadersOnly))
+		respSize := float64(wrec.Size())
+
+		belowThreshold := elapsed < time.Duration(c.MinDurationThreshold)
+		smallResponse := int64(wrec.Size()) < c.MinResponseSize
+		_, sizeExcluded := c.sizeMethods[SanitizeMethod(r.Method)]
+		// revalidated responses carry no body, so they'd only skew the
+		// response sizes towards zero
+		revalidated := c.Revalidations && status == http.StatusNotModified
+
+		if c.metrics != nil {
+			if c.ContentLengthMismatch && contentLengthMismatch(r, wrec) {
+				c.metrics.contentLengthMismatch.With(labels).Inc()
+			}
+			if c.Trailers {
+				hasTrailers, grpcStatus := responseTrailers(wrec.Header())
+				if hasTrailers {
+					c.metrics.responsesWithTrailers.With(labels).Inc()
+				}
+				if grpcStatus != "" {
+					c.metrics.grpcStatus.With(prometheus.Labels{c.hostKey: host, "grpc_status": SanitizeGRPCStatus(grpcStatus)}).Inc()
+				}
+			}
+			if c.RetryAfter && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) {
+				if delay, ok := retryAfter(wrec.Header(), c.clock.Now()); ok {
+					c.metrics.retryAfter.With(labels).Observe(delay.Seconds())
+				}
+			}
+			if c.AgeHeader != "" {
+				if age, ok := responseAge(wrec.Header(), c.AgeHeader); ok {
+					c.metrics.responseAge.With(labels).Observe(age)
+				}
+			}
+			if c.SetCookieCount {
+				c.metrics.responseSetCookieCount.With(labels).Observe(float64(len(wrec.Header()["Set-Cookie"])))
+			}
+			if c.HeaderDelta {
+				c.metrics.responseHeaderDelta.With(labels).Observe(float64(len(wrec.Header()) - headersBefore))
+			}
+			if c.ErrorResponseDuration && status >= 400 {
+				c.metrics.errorResponseDuration.With(prometheus.Labels{c.hostKey: host, c.codeKey: statusLabels[c.codeKey]}).Observe(dur)
+			}
+			if c.metrics.requestDurationFast != nil {
+				c.metrics.requestDurationFast.With(statusLabels).Observe(dur)
+			}
+			if c.metrics.requestDurationSlow != nil {
+				c.metrics.requestDurationSlow.With(statusLabels).Observe(dur)
+			}
+			if _, ok := c.writeMethods[r.Method]; ok && c.metrics.writeRequestDuration != nil {
+				c.metrics.writeRequestDuration.With(labels).Observe(dur)
+			}
+			if c.metrics.responses != nil {
+				c.metrics.responses.With(statusLabels).Inc()
+			}
+			if belowThreshold {
+				c.metrics.requestsBelowDurationThreshold.With(statusLabels).Inc()
+			} else if sampled {
+				c.metrics.requestDuration.With(statusLabels).Observe(dur)
+			}
+			if c.metrics.serverDuration != nil {
+				server := elapsed
+				if !headerAt.IsZero() {
+					server = headerAt.Sub(start)
+				}
+				c.metrics.serverDuration.With(statusLabels).Observe(c.roundDuration(server).Seconds())
+			}
+			if sampled {
+				c.metrics.requestSize.With(statusLabels).Observe(reqSize)
+			}
+			switch {
+			case revalidated:
+				c.metrics.revalidations.With(labels).Inc()
+			case sizeExcluded:
+				// left out of the sizes only
+			case smallResponse:
+				c.metrics.smallResponses.With(statusLabels).Inc()
+			case sampled:
+				c.metrics.responseSize.With(statusLabels).Observe(respSize)
+			}
+			if c.metrics.responseCompressionRatio != nil {
+				if ratio, ok := compressionRatio(wrec.Header(), c.CompressionRatioHeader, wrec.Size()); ok {
+					c.metrics.responseCompressionRatio.With(labels).Observe(ratio)
+				}
+			}
+		}
+		if c.statsd != nil {
+			tags := statsdTags(statusLabels)
+			if belowThreshold {
+				c.statsd.count("requests_below_duration_threshold", tags)
+			} else {
+				c.statsd.timing("request_duration", dur, tags)
+			}
+			c.statsd.histogram("request_size", reqSize, tags)
+			switch {
+			case revalidated:
+				c.statsd.count("revalidations", statsdTags(labels))
+			case sizeExcluded:
+				// left out of the sizes only
+			case smallResponse:
+				c.statsd.count("small_responses", tags)
+			default:
+				c.statsd.histogram("response_size", respSize, tags)
+			}
+		}
+		if c.RecentRequests > 0 {
+			recentRequests.add(recentRequest{
+				Time:         start,
+				Host:         host,
+				Method:       SanitizeMethod(r.Method),
+				Code:         statusLabels[c.codeKey],
+				Duration:     dur,
+				RequestSize:  reqSize,
+				ResponseSize: respSize,
+			})
+		}
+		if c.LogMetrics {
+			c.logger.Info("observed request",
+				zap.String("host", host),
+				zap.String("method", SanitizeMethod(r.Method)),
+				zap.String("code", statusLabels[c.codeKey]),
+				zap.Float64("duration", dur),
+				zap.Float64("request_size", reqSize),
+				zap.Float64("response_size", respSize),
+			)
+		}
+		if c.events != nil {
+			c.events.requestDone(statusLabels, elapsed)
+		}
+	}
+
+	if err != nil {
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			observeRequest(handlerErr.StatusCode)
+		} else if c.ObserveErrors {
+			observeRequest(http.StatusInternalServerError)
+		}
+
+		if c.metrics != nil {
+			c.metrics.requestErrors.With(labels).Inc()
+		}
+		if c.statsd != nil {
+			c.statsd.count("request_errors", statsdTags(labels))
+		}
+		c.logError(r, err, statusLabels)
+		if c.events != nil {
+			c.events.requestFailed(statusLabels, err)
+		}
+
+		if buffered {
+			// what was written must still reach the client, as it would
+			// have if it had been streamed
+			if werr := c.writeBuffered(wrec, labels); werr != nil {
+				c.logger.Debug("writing buffered response", zap.Error(werr))
+			}
+		}
+		return err
+	}
+
+	observeRequest(wrec.Status())
+
+	if buffered {
+		if c.errorBodies != nil {
+			c.errorBodies.observe(host, buf.Bytes())
+		}
+		return c.writeBuffered(wrec, labels)
+	}
+
+	return nil
+}
+
+// writeBuffered writes the buffered response of wrec out to the client.
+func (c *CaddyMetrics) writeBuffered(wrec caddyhttp.ResponseRecorder, labels prometheus.Labels) error {
+	start := c.clock.Now()
+	err := wrec.WriteResponse()
+	if c.metrics != nil && c.metrics.responseBufferFlush != nil {
+		c.metrics.responseBufferFlush.With(labels).Observe(c.clock.Now().Sub(start).Seconds())
+	}
+	return err
+}
+
+// countAborted counts a request aborted without a response.
+func (c *CaddyMetrics) countAborted(labels prometheus.Labels) {
+	if c.metrics != nil {
+		c.metrics.requestCount.With(labels).Inc()
+		c.metrics.requestsAborted.With(labels).Inc()
+	}
+	if c.statsd != nil {
+		c.statsd.count("requests", statsdTags(labels))
+		c.statsd.count("requests_aborted", statsdTags(labels))
+	}
+}
+
+// queryParamCount returns the number of non-empty parameters of the raw
+// query, as url.ParseQuery would split it but without allocating.
+func queryParamCount(rawQuery string) int {
+	var n int
+	for rawQuery != "" {
+		var param string
+		param, rawQuery, _ = strings.Cut(rawQuery, "&")
+		if param != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// compressionRatio returns the uncompressed size of an encoded response, as
+// announced in the header name, over its written size.
+func compressionRatio(header http.Header, name string, size int) (float64, bool) {
+	if encoding := header.Get("Content-Encoding"); encoding == "" || encoding == "identity" || size <= 0 {
+		return 0, false
+	}
+	uncompressed, err := strconv.ParseInt(header.Get(name), 10, 64)
+	if err != nil || uncompressed <= 0 {
+		return 0, false
+	}
+	return float64(uncompressed) / float64(size), true
+}
+
+// histogramSampled decides whether a request is observed in the sampled
+// histograms.
+func (c *CaddyMetrics) histogramSampled() bool {
+	return c.HistogramSampleRate <= 0 || c.HistogramSampleRate >= 1 || rand.Float64() < c.HistogramSampleRate
+}
+
+// shouldBuffer decides whether the recorder buffers a response instead of
+// streaming it to the client. Buffered responses are written out once the
+// handler chain returns.
+func (c *CaddyMetrics) shouldBuffer(status int, header http.Header) bool {
+	return c.errorBodies != nil && c.errorBodies.shouldBuffer(status, header)
+}
+
+// logError logs a sample of the errors counted in request_errors_total
+// along with the request's ID, so that a spike in the metric can be traced
+// back to individual requests.
+func (c *CaddyMetrics) logError(r *http.Request, err error, labels prometheus.Labels) {
+	if c.LogErrorsSampleRate <= 0 || rand.Float64() >= c.LogErrorsSampleRate {
+		return
+	}
+
+	var id string
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		id, _ = repl.GetString("http.request.uuid")
+	}
+
+	fields := make([]zap.Field, 0, len(labels)+2)
+	fields = append(fields, zap.String("request_id", id), zap.Error(err))
+	for name, value := range labels {
+		fields = append(fields, zap.String(name, value))
+	}
+	c.logger.Error("observed request error", fields...)
+}
+
+// serveWebSocket observes a WebSocket upgrade request. The handler chain
+// only returns once the upgraded connection is closed, so its duration is
+// the lifetime of the connection, which would swamp the round-trip duration
+// histogram; such requests get their own metrics instead.
+func (c *CaddyMetrics) serveWebSocket(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, host string) error {
+	labels := prometheus.Labels{c.hostKey: host}
+
+	if c.metrics != nil {
+		inFlight := c.metrics.websocketInFlight.With(labels)
+		inFlight.Inc()
+		defer inFlight.Dec()
+	}
+
+	start := c.clock.Now()
+	err := next.ServeHTTP(w, r)
+	dur := c.clock.Now().Sub(start).Seconds()
+
+	if c.metrics != nil {
+		c.metrics.requestCount.With(labels).Inc()
+		c.metrics.websocketDuration.With(labels).Observe(dur)
+		if err != nil {
+			c.metrics.requestErrors.With(labels).Inc()
+		}
+	}
+	if c.statsd != nil {
+		tags := statsdTags(labels)
+		c.statsd.count("requests", tags)
+		c.statsd.timing("websocket_connection_duration", dur, tags)
+		if err != nil {
+			c.statsd.count("request_errors", tags)
+		}
+	}
+
+	return err
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	extend_metrics {
+//		disable_prometheus
+//		dry_run [<window>]
+//		registry default|caddy|custom:<name>
+//		registries <registry...>
+//		const_labels_for <metric> <label>=<value...>
+//		listen <address>
+//		handler_up [<name>]
+//		config_info
+//		bucket_config_info
+//		min_duration_threshold <duration>
+//		min_ttfb_threshold <duration>
+//		min_response_size <bytes>
+//		duration_resolution <duration>
+//		request_size_headers_only
+//		max_label_length <bytes>
+//		host_label_name <name>
+//		code_label_name <name>
+//		method_label_name <name>
+//		host_allowlist <pattern...>
+//		host_blocklist <pattern...>
+//		other_hosts collapse|skip
+//		invalid_host_handling bucket|sanitize|passthrough
+//		host_group <regexp> <replacement>
+//		host_group_fallback <value>
+//		common_codes [<code...>]
+//		method_labels method|method_class|both
+//		label_value_case upper|lower|preserve
+//		effective_method_label [<header>]
+//		host_sni_match_label
+//		authority_host_match_label
+//		internal_cidrs <cidr...>
+//		transport_label
+//		accept_encoding_label
+//		has_body_label
+//		alpn_label
+//		service_label <template> [<max_values>] [default <value>]
+//		route_id <id>
+//		path_label [<depth> [<max_values>]]
+//		orig_path_label [<depth> [<max_values>]]
+//		var_label <label> <var> [<max_values>] [default <value>]
+//		cert_issuer_label [<issuer_cn...>] {
+//			<issuer_cn> <value>
+//		}
+//		cookie_presence_label <cookie...>
+//		size_class_label [<tiny> <small> <medium> <large>]
+//		auth_label header|context|placeholder <name>
+//		match {
+//			<matchers...>
+//		}
+//		exclude_paths <prefix...>
+//		write_methods [<method...>]
+//		response_size_exclude_methods <method...>
+//		exclude_codes <code...>
+//		sample_rate <fraction>
+//		histogram_sample_rate <fraction>
+//		in_flight_includes_excluded true|false
+//		process_goroutines
+//		in_flight_max [<window>]
+//		in_flight_path_prefixes <prefix...>
+//		max_concurrent <n> [<wait>]
+//		log_metrics
+//		recent_requests <n>
+//		enable_admin
+//		observe_errors true|false
+//		error_response_duration
+//		log_errors [<sample_rate>]
+//		queue_wait
+//		interarrival
+//		query_param_count
+//		chain_depth
+//		header_delta
+//		set_cookie_count
+//		body_read_duration
+//		body_ingress_rate
+//		body_limit_bytes <bytes>
+//		content_length_mismatch
+//		trailers
+//		tls_cert_expiry
+//		revalidations
+//		retry_after
+//		age_metric <header>
+//		flush_count
+//		ttfb_fallback
+//		aborts
+//		server_duration
+//		response_write_errors
+//		error_body_class {
+//			read_bytes <bytes>
+//			max_classes <n>
+//			max_buffer_size <bytes>
+//		}
+//		events {
+//			slow_request <duration>
+//			errors
+//		}
+//		tracing
+//		buffer_flush_duration
+//		buffering_in_flight
+//		connection_requests
+//		h2_concurrent_streams
+//		accept_to_handler
+//		header_size_metric <header...>
+//		compression_ratio <header>
+//		summary_only
+//		duration_buckets <seconds...>|preset:web|api|batch
+//		host_buckets <host> <seconds...>|preset:web|api|batch
+//		size_buckets <bytes...>
+//		duration_fast_buckets <seconds...>|preset:<name>
+//		duration_slow_buckets <seconds...>|preset:<name>
+//		statsd <address> {
+//			format statsd|dogstatsd
+//			prefix <prefix>
+//			flush_interval <duration>
+//			max_packet_size <bytes>
+//		}
+//		observer <module> {
+//			<options...>
+//		}
+//		otlp [<endpoint>] {
+//			endpoint <url>
+//			interval <duration>
+//			header <name> <value>
+//			service_name <name>
+//		}
+//	}
+func (c *CaddyMetrics) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.NextArg()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "disable_prometheus":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.DisablePrometheus = true
+
+		case "dry_run":
+			c.DryRun = caddy.Duration(defaultDryRunWindow)
+			if d.NextArg() {
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing dry_run: %v", err)
+				}
+				c.DryRun = caddy.Duration(dur)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "registry":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Registry = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "registries":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.Registries = append(c.Registries, args...)
+
+		case "const_labels_for":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if c.ConstLabelsFor == nil {
+				c.ConstLabelsFor = make(map[string]map[string]string)
+			}
+			labels := c.ConstLabelsFor[args[0]]
+			if labels == nil {
+				labels = make(map[string]string)
+				c.ConstLabelsFor[args[0]] = labels
+			}
+			for _, arg := range args[1:] {
+				name, value, ok := strings.Cut(arg, "=")
+				if !ok || name == "" {
+					return d.Errf("parsing const_labels_for: expected <label>=<value>, got %q", arg)
+				}
+				labels[name] = value
+			}
+
+		case "listen":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Listen = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "config_info":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ConfigInfo = true
+
+		case "bucket_config_info":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.BucketConfigInfo = true
+
+		case "handler_up":
+			c.HandlerUp = defaultHandlerUpName
+			if d.NextArg() {
+				c.HandlerUp = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "min_duration_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing min_duration_threshold: %v", err)
+			}
+			c.MinDurationThreshold = caddy.Duration(dur)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "min_ttfb_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing min_ttfb_threshold: %v", err)
+			}
+			c.MinTTFBThreshold = caddy.Duration(dur)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "min_response_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return d.Errf("parsing min_response_size: %v", err)
+			}
+			c.MinResponseSize = size
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "duration_resolution":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			res, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing duration_resolution: %v", err)
+			}
+			c.DurationResolution = caddy.Duration(res)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "request_size_headers_only":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.RequestSizeHeadersOnly = true
+
+		case "max_label_length":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			max, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_label_length: %v", err)
+			}
+			if max == 0 {
+				max = -1
+			}
+			c.MaxLabelLength = max
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "host_label_name", "code_label_name", "method_label_name":
+			option := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch option {
+			case "host_label_name":
+				c.HostLabelName = d.Val()
+			case "code_label_name":
+				c.CodeLabelName = d.Val()
+			case "method_label_name":
+				c.MethodLabelName = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "host_allowlist":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.HostAllowlist = append(c.HostAllowlist, args...)
+
+		case "host_blocklist":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.HostBlocklist = append(c.HostBlocklist, args...)
+
+		case "other_hosts":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.OtherHosts = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "invalid_host_handling":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.InvalidHostHandling = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "host_group":
+			var g HostGroup
+			if !d.Args(&g.Pattern, &g.Replacement) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.HostGroups = append(c.HostGroups, g)
+
+		case "host_group_fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.HostGroupFallback = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "common_codes":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				c.CommonCodes = append(c.CommonCodes, defaultCommonCodes...)
+			}
+			for _, arg := range args {
+				code, err := strconv.Atoi(arg)
+				if err != nil {
+					return d.Errf("parsing common_codes: %v", err)
+				}
+				c.CommonCodes = append(c.CommonCodes, code)
+			}
+
+		case "method_labels":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.MethodLabels = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "label_value_case":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.LabelValueCase = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "effective_method_label":
+			c.EffectiveMethodHeader = defaultMethodOverrideHeader
+			if d.NextArg() {
+				c.EffectiveMethodHeader = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "transport_label":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.TransportLabel = true
+
+		case "accept_encoding_label":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.AcceptEncodingLabel = true
+
+		case "has_body_label":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.HasBodyLabel = true
+
+		case "alpn_label":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ALPNLabel = true
+
+		case "internal_cidrs":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.InternalCIDRs = append(c.InternalCIDRs, args...)
+
+		case "host_sni_match_label":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.HostSNIMatchLabel = true
+
+		case "authority_host_match_label":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.AuthorityHostMatchLabel = true
+
+		case "route_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.RouteID = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "path_label", "orig_path_label":
+			directive := d.Val()
+			p, err := parsePathLabel(d)
+			if err != nil {
+				return err
+			}
+			if directive == "path_label" {
+				c.PathLabel = p
+			} else {
+				c.OrigPathLabel = p
+			}
+
+		case "var_label":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			v := &VarLabel{Label: args[0], Var: args[1]}
+			var err error
+			v.MaxValues, v.Default, err = parseDynamicLabelArgs(d, "var_label", args[2:])
+			if err != nil {
+				return err
+			}
+			c.VarLabels = append(c.VarLabels, v)
+
+		case "service_label":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.ServiceLabel = args[0]
+			var err error
+			c.ServiceLabelMaxValues, c.ServiceLabelDefault, err = parseDynamicLabelArgs(d, "service_label", args[1:])
+			if err != nil {
+				return err
+			}
+
+		case "cert_issuer_label":
+			if c.CertIssuers == nil {
+				c.CertIssuers = make(map[string]string)
+			}
+			for _, arg := range d.RemainingArgs() {
+				c.CertIssuers[arg] = arg
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				issuer := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.CertIssuers[issuer] = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+			if len(c.CertIssuers) == 0 {
+				return d.ArgErr()
+			}
+
+		case "cookie_presence_label":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.CookiePresenceLabels = append(c.CookiePresenceLabels, args...)
+
+		case "size_class_label":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				c.SizeClasses = append([]int64(nil), defaultSizeClasses...)
+			}
+			for _, arg := range args {
+				threshold, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil {
+					return d.Errf("parsing size_class_label: %v", err)
+				}
+				c.SizeClasses = append(c.SizeClasses, threshold)
+			}
+
+		case "auth_label":
+			var source, name string
+			if !d.Args(&source, &name) {
+				return d.ArgErr()
+			}
+			c.AuthLabel = &AuthLabel{Source: source, Name: name}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "match":
+			matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(d)
+			if err != nil {
+				return d.Errf("parsing match: %v", err)
+			}
+			c.MatchRaw = append(c.MatchRaw, matcherSet)
+
+		case "exclude_paths":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.ExcludePaths = append(c.ExcludePaths, args...)
+
+		case "write_methods":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				args = defaultWriteMethods
+			}
+			c.WriteMethods = append(c.WriteMethods, args...)
+
+		case "response_size_exclude_methods":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.ResponseSizeExcludeMethods = append(c.ResponseSizeExcludeMethods, args...)
+
+		case "exclude_codes":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				code, err := strconv.Atoi(arg)
+				if err != nil {
+					return d.Errf("parsing exclude_codes: %v", err)
+				}
+				c.ExcludeCodes = append(c.ExcludeCodes, code)
+			}
+
+		case "sample_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("parsing sample_rate: %v", err)
+			}
+			c.SampleRate = rate
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "histogram_sample_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("parsing histogram_sample_rate: %v", err)
+			}
+			c.HistogramSampleRate = rate
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "in_flight_includes_excluded":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			include, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.Errf("parsing in_flight_includes_excluded: %v", err)
+			}
+			c.InFlightIncludesExcluded = &include
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "observe_errors":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			observe, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.Errf("parsing observe_errors: %v", err)
+			}
+			c.ObserveErrors = observe
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "process_goroutines":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ProcessGoroutines = true
+
+		case "in_flight_max":
+			c.InFlightMaxWindow = caddy.Duration(defaultInFlightMaxWindow)
+			if d.NextArg() {
+				window, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing in_flight_max window: %v", err)
+				}
+				c.InFlightMaxWindow = caddy.Duration(window)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "max_concurrent":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_concurrent: %v", err)
+			}
+			c.MaxConcurrent = n
+			if d.NextArg() {
+				wait, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_concurrent wait: %v", err)
+				}
+				c.MaxConcurrentWait = caddy.Duration(wait)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "in_flight_path_prefixes":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.InFlightPathPrefixes = append(c.InFlightPathPrefixes, args...)
+
+		case "error_response_duration":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ErrorResponseDuration = true
+
+		case "log_errors":
+			c.LogErrorsSampleRate = 1
+			if d.NextArg() {
+				rate, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("parsing log_errors sample rate: %v", err)
+				}
+				c.LogErrorsSampleRate = rate
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "log_metrics":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.LogMetrics = true
+
+		case "recent_requests":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing recent_requests: %v", err)
+			}
+			c.RecentRequests = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "enable_admin":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.EnableAdmin = true
+
+		case "set_cookie_count":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.SetCookieCount = true
+
+		case "chain_depth":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ChainDepth = true
+
+		case "queue_wait":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.QueueWait = true
+
+		case "interarrival":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Interarrival = true
+
+		case "query_param_count":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.QueryParamCount = true
+
+		case "header_delta":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.HeaderDelta = true
+
+		case "body_limit_bytes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			limit, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return d.Errf("parsing body_limit_bytes: %v", err)
+			}
+			c.BodyLimitBytes = limit
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "body_ingress_rate":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.BodyIngressRate = true
+
+		case "body_read_duration":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.BodyReadDuration = true
+
+		case "content_length_mismatch":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ContentLengthMismatch = true
+
+		case "tls_cert_expiry":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.TLSCertExpiry = true
+
+		case "header_size_metric":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.HeaderSizeMetrics = append(c.HeaderSizeMetrics, args...)
+
+		case "compression_ratio":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.CompressionRatioHeader = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "accept_to_handler":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.AcceptToHandler = true
+
+		case "buffer_flush_duration":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.BufferFlushDuration = true
+
+		case "buffering_in_flight":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.BufferingInFlight = true
+
+		case "connection_requests":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ConnectionRequests = true
+
+		case "h2_concurrent_streams":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.H2ConcurrentStreams = true
+
+		case "error_body_class":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ErrorBodyClass = new(ErrorBodyClass)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("parsing %s: %v", option, err)
+				}
+				switch option {
+				case "read_bytes":
+					c.ErrorBodyClass.ReadBytes = n
+				case "max_classes":
+					c.ErrorBodyClass.MaxClasses = n
+				case "max_buffer_size":
+					c.ErrorBodyClass.MaxBufferSize = n
+				default:
+					return d.Errf("unrecognized error_body_class option: %s", option)
+				}
+			}
+
+		case "events":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Events = new(Events)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "slow_request":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing slow_request: %v", err)
+					}
+					c.Events.SlowRequest = caddy.Duration(dur)
+				case "errors":
+					c.Events.Errors = true
+				default:
+					return d.Errf("unrecognized events option: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+
+		case "tracing":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Tracing = true
+
+		case "flush_count":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.FlushCount = true
+
+		case "ttfb_fallback":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.TTFBFallback = true
+
+		case "aborts":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Aborts = true
+
+		case "server_duration":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ServerDuration = true
+
+		case "response_write_errors":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ResponseWriteErrors = true
+
+		case "retry_after":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.RetryAfter = true
+
+		case "age_metric":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.AgeHeader = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "revalidations":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Revalidations = true
+
+		case "trailers":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Trailers = true
+
+		case "summary_only":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.SummaryOnly = true
+
+		case "duration_buckets":
+			buckets, err := parseBuckets(d)
+			if err != nil {
+				return err
+			}
+			c.DurationBuckets = buckets
+
+		case "host_buckets":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			host := d.Val()
+			buckets, err := parseBucketArgs(d, "host_buckets", d.RemainingArgs())
+			if err != nil {
+				return err
+			}
+			c.HostBuckets = append(c.HostBuckets, HostBuckets{Host: host, Buckets: buckets})
+
+		case "size_buckets":
+			buckets, err := parseBuckets(d)
+			if err != nil {
+				return err
+			}
+			c.SizeBuckets = buckets
+
+		case "duration_fast_buckets":
+			buckets, err := parseBuckets(d)
+			if err != nil {
+				return err
+			}
+			c.DurationFastBuckets = buckets
+
+		case "duration_slow_buckets":
+			buckets, err := parseBuckets(d)
+			if err != nil {
+				return err
+			}
+			c.DurationSlowBuckets = buckets
+
+		case "statsd":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.StatsD = &StatsD{Address: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "format":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					c.StatsD.Format = d.Val()
+				case "prefix":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					c.StatsD.Prefix = d.Val()
+				case "flush_interval":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing flush_interval: %v", err)
+					}
+					c.StatsD.FlushInterval = caddy.Duration(dur)
+				case "max_packet_size":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("parsing max_packet_size: %v", err)
+					}
+					c.StatsD.MaxPacketSize = size
+				default:
+					return d.Errf("unrecognized statsd option: %s", d.Val())
+				}
+			}
+
+		case "observer":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.extend_metrics.observers."+name)
+			if err != nil {
+				return err
+			}
+			c.ObserversRaw = append(c.ObserversRaw, caddyconfig.JSONModuleObject(unm, "observer", name, nil))
+
+		case "otlp":
+			c.OTLP = new(OTLP)
+			if d.NextArg() {
+				c.OTLP.Endpoint = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "endpoint":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					c.OTLP.Endpoint = d.Val()
+				case "interval":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing interval: %v", err)
+					}
+					c.OTLP.Interval = caddy.Duration(dur)
+				case "header":
+					var name, value string
+					if !d.Args(&name, &value) {
+						return d.ArgErr()
+					}
+					if c.OTLP.Headers == nil {
+						c.OTLP.Headers = make(map[string]string)
+					}
+					c.OTLP.Headers[name] = value
+				case "service_name":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					c.OTLP.ServiceName = d.Val()
+				default:
+					return d.Errf("unrecognized otlp option: %s", d.Val())
+				}
+			}
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// parseBuckets parses the remaining arguments on the line as bucket
+// boundaries, or as a single `preset:<name>`.
+func parseBuckets(d *caddyfile.Dispenser) ([]float64, error) {
+	return parseBucketArgs(d, d.Val(), d.RemainingArgs())
+}
+
+func parseBucketArgs(d *caddyfile.Dispenser, name string, args []string) ([]float64, error) {
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	if len(args) == 1 && strings.HasPrefix(args[0], bucketPresetPrefix) {
+		preset, ok := bucketPresets[strings.TrimPrefix(args[0], bucketPresetPrefix)]
+		if !ok {
+			return nil, d.Errf("unrecognized %s preset: %s", name, args[0])
+		}
+		return append([]float64(nil), preset...), nil
+	}
+	buckets := make([]float64, 0, len(args))
+	for _, arg := range args {
+		b, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, d.Errf("parsing %s: %v", name, err)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// parsePathLabel parses the `[<depth> [<max_values>]]` arguments of the
+// path labels.
+func parsePathLabel(d *caddyfile.Dispenser) (*PathLabel, error) {
+	name := d.Val()
+	args := d.RemainingArgs()
+	if len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	p := new(PathLabel)
+	for i, dst := range []*int{&p.Depth, &p.MaxValues} {
+		if i >= len(args) {
+			break
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil {
+			return nil, d.Errf("parsing %s: %v", name, err)
+		}
+		*dst = n
+	}
+	return p, nil
+}
+
+// parseDynamicLabelArgs parses the `[<max_values>] [default <value>]`
+// arguments of the labels taken from the request.
+func parseDynamicLabelArgs(d *caddyfile.Dispenser, name string, args []string) (max int, def string, err error) {
+	if len(args) > 0 && args[0] != "default" {
+		max, err = strconv.Atoi(args[0])
+		if err != nil {
+			return 0, "", d.Errf("parsing %s: %v", name, err)
+		}
+		args = args[1:]
+	}
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "default":
+		def = args[1]
+	default:
+		return 0, "", d.ArgErr()
+	}
+	return max, def, nil
 }
 
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
@@ -126,6 +3041,8 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 }
 
 var (
+	_ caddy.Provisioner           = (*CaddyMetrics)(nil)
+	_ caddy.CleanerUpper          = (*CaddyMetrics)(nil)
 	_ caddyhttp.MiddlewareHandler = (*CaddyMetrics)(nil)
 	_ caddyfile.Unmarshaler       = (*CaddyMetrics)(nil)
 )
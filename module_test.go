@@ -0,0 +1,218 @@
+package extend_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// newTestContext returns the context of a new config.
+func newTestContext(t *testing.T) caddy.Context {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// parseTestCaddyfile sets up a handler from Caddyfile text.
+func parseTestCaddyfile(t *testing.T, input string) *CaddyMetrics {
+	t.Helper()
+	c := new(CaddyMetrics)
+	if err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("parsing %q: %v", input, err)
+	}
+	return c
+}
+
+// provisionTestHandler sets up and provisions a handler of the config of
+// ctx from Caddyfile text, and cleans it up at the end of the test.
+func provisionTestHandler(t *testing.T, ctx caddy.Context, input string) (*CaddyMetrics, error) {
+	t.Helper()
+	c := parseTestCaddyfile(t, input)
+	err := c.Provision(ctx)
+	t.Cleanup(func() { c.Cleanup() })
+	return c, err
+}
+
+// serveTestRequest passes a request to url through c to next.
+func serveTestRequest(c *CaddyMetrics, method, url string, next caddyhttp.Handler) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	repl := caddyhttp.NewTestReplacer(r)
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r, next)
+	return w
+}
+
+var okHandler = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte("ok"))
+	return err
+})
+
+// scrapeTestRegistry returns the samples of the handler's metrics in the
+// registry of spec, in the text format.
+func scrapeTestRegistry(t *testing.T, spec string) string {
+	t.Helper()
+	e := &Exporter{Registry: spec, DisableOpenMetrics: true}
+	if err := e.Provision(newTestContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), nil)
+	var samples []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "caddy_http_extend_") {
+			samples = append(samples, line)
+		}
+	}
+	return strings.Join(samples, "\n")
+}
+
+func TestUnmarshalCaddyfilePathLabels(t *testing.T) {
+	for _, tt := range []struct {
+		input      string
+		path, orig *PathLabel
+	}{
+		{input: `extend_metrics {
+			path_label
+		}`, path: &PathLabel{}},
+		{input: `extend_metrics {
+			path_label 3 100
+		}`, path: &PathLabel{Depth: 3, MaxValues: 100}},
+		{input: `extend_metrics {
+			orig_path_label 2
+		}`, orig: &PathLabel{Depth: 2}},
+		{input: `extend_metrics {
+			path_label 1
+			orig_path_label 4 50
+		}`, path: &PathLabel{Depth: 1}, orig: &PathLabel{Depth: 4, MaxValues: 50}},
+	} {
+		c := parseTestCaddyfile(t, tt.input)
+		if !equalPathLabel(c.PathLabel, tt.path) {
+			t.Errorf("%q: expected path_label %+v, got %+v", tt.input, tt.path, c.PathLabel)
+		}
+		if !equalPathLabel(c.OrigPathLabel, tt.orig) {
+			t.Errorf("%q: expected orig_path_label %+v, got %+v", tt.input, tt.orig, c.OrigPathLabel)
+		}
+	}
+
+	for _, input := range []string{
+		`extend_metrics {
+			path_label 1 2 3
+		}`,
+		`extend_metrics {
+			orig_path_label deep
+		}`,
+	} {
+		c := new(CaddyMetrics)
+		if err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func equalPathLabel(a, b *PathLabel) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func TestUnmarshalCaddyfileExtraArgs(t *testing.T) {
+	for _, directive := range []string{
+		"histogram_sample_rate 0.5 0.1",
+		"observe_errors true extra",
+		"in_flight_includes_excluded true extra",
+		"max_label_length 64 128",
+		"sample_rate 0.5 0.1",
+		"min_ttfb_threshold 10ms 20ms",
+		"min_duration_threshold 10ms 20ms",
+	} {
+		input := "extend_metrics {\n" + directive + "\n}"
+		c := new(CaddyMetrics)
+		if err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%s: expected an error", directive)
+		}
+	}
+}
+
+func TestServerDuration(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	c := parseTestCaddyfile(t, `extend_metrics {
+		registry custom:test_server_duration
+		server_duration
+	}`)
+	c.Clock = clock
+	if err := c.Provision(newTestContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Cleanup() })
+
+	serveTestRequest(c, "GET", "http://example.com/", caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		clock.advance(time.Second)
+		w.WriteHeader(http.StatusOK)
+		clock.advance(4 * time.Second)
+		_, err := w.Write([]byte("slow body"))
+		return err
+	}))
+	serveTestRequest(c, "GET", "http://example.com/", caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		clock.advance(2 * time.Second)
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("upstream down"))
+	}))
+
+	samples := scrapeTestRegistry(t, "custom:test_server_duration")
+	for _, want := range []string{
+		`caddy_http_extend_server_duration_seconds_sum{code="200",host="example.com",method="GET"} 1`,
+		`caddy_http_extend_server_duration_seconds_sum{code="502",host="example.com",method="GET"} 2`,
+		`caddy_http_extend_request_duration_seconds_sum{code="200",host="example.com",method="GET"} 5`,
+	} {
+		if !strings.Contains(samples, want) {
+			t.Errorf("expected %s, got:\n%s", want, samples)
+		}
+	}
+}
+
+func TestObserveErrors(t *testing.T) {
+	failing := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return errors.New("connection reset")
+	})
+	handlerErr := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("upstream down"))
+	})
+	for _, observe := range []bool{true, false} {
+		spec := fmt.Sprintf("custom:test_observe_errors_%t", observe)
+		c, err := provisionTestHandler(t, newTestContext(t), fmt.Sprintf(`extend_metrics {
+			registry %s
+			observe_errors %t
+		}`, spec, observe))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serveTestRequest(c, "GET", "http://example.com/", failing)
+		serveTestRequest(c, "GET", "http://example.com/", handlerErr)
+
+		samples := scrapeTestRegistry(t, spec)
+		for _, want := range []string{
+			`caddy_http_extend_request_duration_seconds_count{code="502",host="example.com",method="GET"} 1`,
+			`caddy_http_extend_request_errors_total{host="example.com"} 2`,
+		} {
+			if !strings.Contains(samples, want) {
+				t.Errorf("observe_errors %t: expected %s, got:\n%s", observe, want, samples)
+			}
+		}
+		const generic = `caddy_http_extend_request_duration_seconds_count{code="500",host="example.com",method="GET"} 1`
+		if strings.Contains(samples, generic) != observe {
+			t.Errorf("observe_errors %t: expected the generic error observed: %t, got:\n%s", observe, observe, samples)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package extend_metrics
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// RequestObserver is implemented by modules in the
+// `http.extend_metrics.observers` namespace, which are called with the
+// outcome of every observed request, such as to feed systems other than
+// the metrics sinks. Observers are called synchronously from the request's
+// goroutine, so they should hand slow work off elsewhere.
+type RequestObserver interface {
+	ObserveRequest(r *http.Request, stats RequestStats)
+}
+
+// RequestStartObserver may additionally be implemented by observers to be
+// called before the request is passed down the handler chain.
+type RequestStartObserver interface {
+	RequestStarted(r *http.Request)
+}
+
+// RequestStats describes the outcome of an observed request.
+type RequestStats struct {
+	// The host label value of the request.
+	Host string
+
+	// The sanitized method of the request.
+	Method string
+
+	// The status code of the response, or of the handler error. It is 0 if
+	// the handler chain failed without writing a response.
+	Status int
+
+	// The round-trip duration of the request.
+	Duration time.Duration
+
+	// The approximate size of the request, including its body.
+	RequestSize int
+
+	// The number of response body bytes written.
+	ResponseSize int
+
+	// The error returned by the handler chain, if any.
+	Err error
+}
+
+// notifyObservers calls the observers and OnObserve with the outcome of a
+// request.
+func (c *CaddyMetrics) notifyObservers(r *http.Request, host string, wrec caddyhttp.ResponseRecorder, err error, dur time.Duration) {
+	stats := RequestStats{
+		Host:         host,
+		Method:       SanitizeMethod(r.Method),
+		Status:       wrec.Status(),
+		Duration:     dur,
+		RequestSize:  computeApproximateRequestSize(r, true),
+		ResponseSize: wrec.Size(),
+		Err:          err,
+	}
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) {
+		stats.Status = handlerErr.StatusCode
+	}
+	for _, o := range c.observers {
+		o.ObserveRequest(r, stats)
+	}
+	if c.OnObserve != nil {
+		c.OnObserve(stats)
+	}
+}
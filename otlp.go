@@ -0,0 +1,397 @@
+package extend_metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultOTLPEndpoint    = "http://localhost:4318/v1/metrics"
+	defaultOTLPInterval    = time.Minute
+	defaultOTLPServiceName = "caddy"
+	otlpScopeName          = "github.com/yoshino-s/caddy-metrics"
+	otlpFamilyPrefix       = "caddy_http_extend_"
+	otlpCumulative         = 2
+)
+
+// otlpUpDownCounters are the gauges exported as non-monotonic sums, which
+// go up and down with the requests in flight.
+var otlpUpDownCounters = map[string]bool{
+	otlpFamilyPrefix + "requests_in_flight":                true,
+	otlpFamilyPrefix + "requests_in_flight_by_path_prefix": true,
+	otlpFamilyPrefix + "requests_buffering_in_flight":      true,
+	otlpFamilyPrefix + "websocket_connections_in_flight":   true,
+}
+
+// OTLP configures an optional exporter pushing the handler's metrics to an
+// OpenTelemetry collector over OTLP/HTTP, using the JSON encoding.
+//
+// The measurements are those of the Prometheus collectors: counters become
+// monotonic sums, the in-flight gauges non-monotonic sums and histograms
+// explicit bucket histograms, all with cumulative temporality, while
+// summaries are kept as such. The series start when their collector was
+// created, which a reload changing the metrics resets. Every
+// `extend_metrics` family of the registry is exported, so enable it on a
+// single handler per registry. With `disable_prometheus` the collectors
+// are registered into a private registry only this exporter reads.
+type OTLP struct {
+	// The URL metrics are posted to.
+	// Default: `http://localhost:4318/v1/metrics`.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// How often metrics are exported. Default: 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Extra headers sent with every export, such as for authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// The `service.name` resource attribute. Default: `caddy`.
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+// otlpExporter periodically gathers the registry and posts it. Exports run
+// on their own goroutine and failures are only logged, so a slow or missing
+// collector never affects request serving.
+type otlpExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	gatherer    prometheus.Gatherer
+	client      *http.Client
+	logger      *zap.Logger
+
+	// start is the start of the up-down counters, which have no creation
+	// time of their own.
+	start time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newOTLPExporter(cfg *OTLP, gatherer prometheus.Gatherer, logger *zap.Logger) *otlpExporter {
+	e := &otlpExporter{
+		endpoint:    cfg.Endpoint,
+		headers:     cfg.Headers,
+		serviceName: cfg.ServiceName,
+		gatherer:    gatherer,
+		logger:      logger,
+		start:       time.Now(),
+		done:        make(chan struct{}),
+	}
+	if e.endpoint == "" {
+		e.endpoint = defaultOTLPEndpoint
+	}
+	if e.serviceName == "" {
+		e.serviceName = defaultOTLPServiceName
+	}
+	interval := time.Duration(cfg.Interval)
+	if interval <= 0 {
+		interval = defaultOTLPInterval
+	}
+	e.client = &http.Client{Timeout: interval}
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.export()
+			case <-e.done:
+				e.export()
+				return
+			}
+		}
+	}()
+
+	return e
+}
+
+func (e *otlpExporter) stop() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *otlpExporter) export() {
+	if err := e.send(); err != nil {
+		e.logger.Warn("failed to export otlp metrics", zap.String("endpoint", e.endpoint), zap.Error(err))
+	}
+}
+
+func (e *otlpExporter) send() error {
+	families, err := e.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return fmt.Errorf("gathering metrics: %v", err)
+	}
+
+	now := time.Now()
+	var metrics []otlpMetric
+	for _, mf := range families {
+		if !strings.HasPrefix(mf.GetName(), otlpFamilyPrefix) {
+			continue
+		}
+		if m, ok := otlpConvert(mf, e.start, now); ok {
+			metrics = append(metrics, m)
+		}
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(otlpRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{Attributes: []otlpAttribute{otlpString("service.name", e.serviceName)}},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: otlpScopeName},
+				Metrics: metrics,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpConvert converts a Prometheus metric family into its OTLP equivalent.
+// The cumulative series start when their collector was created, or at
+// start when it doesn't tell.
+func otlpConvert(mf *dto.MetricFamily, start, now time.Time) (otlpMetric, bool) {
+	m := otlpMetric{
+		Name:        mf.GetName(),
+		Description: mf.GetHelp(),
+	}
+	switch {
+	case strings.HasSuffix(m.Name, "_seconds"):
+		m.Unit = "s"
+	case strings.HasSuffix(m.Name, "_bytes"):
+		m.Unit = "By"
+	}
+
+	startNano := strconv.FormatInt(start.UnixNano(), 10)
+	nowNano := strconv.FormatInt(now.UnixNano(), 10)
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		m.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		for _, metric := range mf.GetMetric() {
+			m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberDataPoint{
+				Attributes:        otlpAttributes(metric.GetLabel()),
+				StartTimeUnixNano: otlpStart(metric.GetCounter().GetCreatedTimestamp(), startNano),
+				TimeUnixNano:      nowNano,
+				AsDouble:          metric.GetCounter().GetValue(),
+			})
+		}
+
+	case dto.MetricType_GAUGE:
+		var points []otlpNumberDataPoint
+		for _, metric := range mf.GetMetric() {
+			points = append(points, otlpNumberDataPoint{
+				Attributes:   otlpAttributes(metric.GetLabel()),
+				TimeUnixNano: nowNano,
+				AsDouble:     metric.GetGauge().GetValue(),
+			})
+		}
+		if otlpUpDownCounters[m.Name] {
+			// in-flight gauges are up-down counters
+			for i := range points {
+				points[i].StartTimeUnixNano = startNano
+			}
+			m.Sum = &otlpSum{AggregationTemporality: otlpCumulative, DataPoints: points}
+		} else {
+			m.Gauge = &otlpGauge{DataPoints: points}
+		}
+
+	case dto.MetricType_HISTOGRAM:
+		m.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+		for _, metric := range mf.GetMetric() {
+			h := metric.GetHistogram()
+			point := otlpHistogramDataPoint{
+				Attributes:        otlpAttributes(metric.GetLabel()),
+				StartTimeUnixNano: otlpStart(h.GetCreatedTimestamp(), startNano),
+				TimeUnixNano:      nowNano,
+				Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+				Sum:               h.GetSampleSum(),
+			}
+			// Prometheus buckets are cumulative, OTLP ones are not
+			var previous uint64
+			for _, b := range h.GetBucket() {
+				point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-previous, 10))
+				previous = b.GetCumulativeCount()
+			}
+			point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+			m.Histogram.DataPoints = append(m.Histogram.DataPoints, point)
+		}
+
+	case dto.MetricType_SUMMARY:
+		m.Summary = &otlpSummary{}
+		for _, metric := range mf.GetMetric() {
+			s := metric.GetSummary()
+			point := otlpSummaryDataPoint{
+				Attributes:        otlpAttributes(metric.GetLabel()),
+				StartTimeUnixNano: otlpStart(s.GetCreatedTimestamp(), startNano),
+				TimeUnixNano:      nowNano,
+				Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+				Sum:               s.GetSampleSum(),
+			}
+			for _, q := range s.GetQuantile() {
+				point.QuantileValues = append(point.QuantileValues, otlpQuantileValue{Quantile: q.GetQuantile(), Value: q.GetValue()})
+			}
+			m.Summary.DataPoints = append(m.Summary.DataPoints, point)
+		}
+
+	default:
+		return otlpMetric{}, false
+	}
+	return m, true
+}
+
+// otlpStart returns the start time of a cumulative series created at
+// created, or fallback when unknown.
+func otlpStart(created *timestamppb.Timestamp, fallback string) string {
+	if created == nil {
+		return fallback
+	}
+	return strconv.FormatInt(created.AsTime().UnixNano(), 10)
+}
+
+func otlpAttributes(labels []*dto.LabelPair) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(labels))
+	for _, l := range labels {
+		attrs = append(attrs, otlpString(l.GetName(), l.GetValue()))
+	}
+	return attrs
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// The OTLP/JSON request types, a subset of the protobuf schema in its JSON
+// mapping, under which 64-bit integers are encoded as strings.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	BucketCounts      []string        `json:"bucketCounts"`
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpAttribute     `json:"attributes"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	TimeUnixNano      string              `json:"timeUnixNano"`
+	Count             string              `json:"count"`
+	Sum               float64             `json:"sum"`
+	QuantileValues    []otlpQuantileValue `json:"quantileValues,omitempty"`
+}
+
+type otlpQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
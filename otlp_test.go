@@ -0,0 +1,77 @@
+package extend_metrics
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gatherTestFamilies(t *testing.T, collectors ...prometheus.Collector) map[string]*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors...)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+func TestOTLPConvertStartTime(t *testing.T) {
+	created := time.Now()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "caddy_http_extend_requests_total", Help: "test"})
+	counter.Inc()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "caddy_http_extend_request_duration_seconds", Help: "test"})
+	histogram.Observe(1)
+	families := gatherTestFamilies(t, counter, histogram)
+
+	// an exporter started long before, such as one outliving a reload
+	// which replaced the collectors
+	start := created.Add(-time.Hour)
+	for name, mf := range families {
+		m, ok := otlpConvert(mf, start, time.Now())
+		if !ok {
+			t.Fatalf("%s: not converted", name)
+		}
+		var startNano string
+		if m.Sum != nil {
+			startNano = m.Sum.DataPoints[0].StartTimeUnixNano
+		} else {
+			startNano = m.Histogram.DataPoints[0].StartTimeUnixNano
+		}
+		ns, err := strconv.ParseInt(startNano, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := time.Unix(0, ns); got.Before(created.Add(-time.Second)) {
+			t.Errorf("%s: expected the series to start when the collector was created (%v), got %v", name, created, got)
+		}
+	}
+}
+
+func TestOTLPConvertUpDownCounters(t *testing.T) {
+	var collectors []prometheus.Collector
+	for _, name := range []string{"requests_in_flight", "requests_in_flight_by_path_prefix", "requests_buffering_in_flight", "websocket_connections_in_flight", "requests_in_flight_max"} {
+		collectors = append(collectors, prometheus.NewGauge(prometheus.GaugeOpts{Name: otlpFamilyPrefix + name, Help: "test"}))
+	}
+	for name, mf := range gatherTestFamilies(t, collectors...) {
+		m, ok := otlpConvert(mf, time.Now(), time.Now())
+		if !ok {
+			t.Fatalf("%s: not converted", name)
+		}
+		upDown := name != otlpFamilyPrefix+"requests_in_flight_max"
+		if got := m.Sum != nil && !m.Sum.IsMonotonic; got != upDown {
+			t.Errorf("%s: expected a non-monotonic sum: %v, got %+v", name, upDown, m)
+		}
+		if !upDown && m.Gauge == nil {
+			t.Errorf("%s: expected a gauge, got %+v", name, m)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package extend_metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminRecentRequests{})
+}
+
+// recentRequest is the entry of an observed request in the ring buffer.
+type recentRequest struct {
+	Time         time.Time `json:"time"`
+	Host         string    `json:"host"`
+	Method       string    `json:"method"`
+	Code         string    `json:"code"`
+	Duration     float64   `json:"duration"`
+	RequestSize  float64   `json:"request_size"`
+	ResponseSize float64   `json:"response_size"`
+}
+
+// recentRequests is the ring buffer of the last observed requests, shared
+// by every handler with recent_requests enabled so that it survives config
+// reloads. It holds as many entries as the largest size configured since
+// the process started.
+var recentRequests = &requestRing{}
+
+type requestRing struct {
+	mu      sync.Mutex
+	entries []recentRequest
+	next    int
+	full    bool
+}
+
+// grow makes room for at least n entries, keeping the current ones.
+func (b *requestRing) grow(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n <= len(b.entries) {
+		return
+	}
+	entries := b.snapshotLocked()
+	b.entries = make([]recentRequest, n)
+	b.next = copy(b.entries, entries)
+	b.full = false
+}
+
+func (b *requestRing) add(e recentRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.entries) == 0 {
+		return
+	}
+	b.entries[b.next] = e
+	b.next++
+	if b.next == len(b.entries) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+// snapshot returns the entries from the oldest to the newest.
+func (b *requestRing) snapshot() []recentRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.snapshotLocked()
+}
+
+func (b *requestRing) snapshotLocked() []recentRequest {
+	if !b.full {
+		return append([]recentRequest(nil), b.entries[:b.next]...)
+	}
+	entries := make([]recentRequest, 0, len(b.entries))
+	entries = append(entries, b.entries[b.next:]...)
+	return append(entries, b.entries[:b.next]...)
+}
+
+// adminRecentRequests serves the ring buffer on the admin endpoint, at
+// `/extend_metrics/recent_requests`.
+type adminRecentRequests struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminRecentRequests) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.extend_metrics_recent_requests",
+		New: func() caddy.Module { return new(adminRecentRequests) },
+	}
+}
+
+// Routes returns the admin routes of the ring buffer.
+func (a *adminRecentRequests) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{
+		Pattern: "/extend_metrics/recent_requests",
+		Handler: caddy.AdminHandlerFunc(a.serveRecentRequests),
+	}}
+}
+
+func (a *adminRecentRequests) serveRecentRequests(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(recentRequests.snapshot())
+}
+
+var _ caddy.AdminRouter = (*adminRecentRequests)(nil)
@@ -0,0 +1,183 @@
+package extend_metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const customRegistryPrefix = "custom:"
+
+var namedRegistries = struct {
+	mu         sync.Mutex
+	registries map[string]*prometheus.Registry
+}{
+	registries: make(map[string]*prometheus.Registry),
+}
+
+// NamedRegistry returns the custom registry with the given name, creating it
+// on first use. Other modules may register their own collectors into it.
+func NamedRegistry(name string) *prometheus.Registry {
+	namedRegistries.mu.Lock()
+	defer namedRegistries.mu.Unlock()
+
+	reg, ok := namedRegistries.registries[name]
+	if !ok {
+		reg = prometheus.NewRegistry()
+		namedRegistries.registries[name] = reg
+	}
+	return reg
+}
+
+// resolveRegistry returns the registry described by spec, which is one of
+// `default`, `caddy` or `custom:<name>`. Caddy serves the default registry
+// from its own metrics endpoints, so `default` and `caddy` are the same.
+func resolveRegistry(spec string) (*registryRef, error) {
+	switch {
+	case spec == "", spec == "default", spec == "caddy":
+		return &registryRef{
+			Registerer: prometheus.DefaultRegisterer,
+			Gatherer:   prometheus.DefaultGatherer,
+		}, nil
+	case strings.HasPrefix(spec, customRegistryPrefix):
+		name := strings.TrimPrefix(spec, customRegistryPrefix)
+		if name == "" {
+			return nil, fmt.Errorf("custom registry requires a name: %s", spec)
+		}
+		reg := NamedRegistry(name)
+		return &registryRef{Registerer: reg, Gatherer: reg}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized registry: %s", spec)
+	}
+}
+
+// registryRef pairs the two views of a registry.
+type registryRef struct {
+	prometheus.Registerer
+	prometheus.Gatherer
+}
+
+// configID identifies the Caddy config an instance belongs to. The context
+// of a config, and of every module in it, shares the Done channel cancelled
+// once the config is unloaded.
+type configID <-chan struct{}
+
+// registeredCollectors tracks the collectors registered into each
+// registry and the instances using them, so that a collector stops being
+// collected once the last of them is cleaned up. During a reload the new
+// config is provisioned before the old one is cleaned up, so a collector of
+// the old config which the new one can't adopt, such as one with other
+// label names or buckets, is replaced right away.
+var registeredCollectors = struct {
+	mu     sync.Mutex
+	slots  map[slotKey]*collectorSlot
+	owners map[collectorKey]*collectorOwners
+}{
+	slots:  make(map[slotKey]*collectorSlot),
+	owners: make(map[collectorKey]*collectorOwners),
+}
+
+// slotKey is the place of a metric in a registry: its name along with its
+// const labels.
+type slotKey struct {
+	reg prometheus.Registerer
+	id  string
+}
+
+// collectorKey is a collector collected through a registry.
+type collectorKey struct {
+	reg prometheus.Registerer
+	c   prometheus.Collector
+}
+
+type collectorOwners struct {
+	slot *collectorSlot
+	refs map[configID]int
+}
+
+// collectorSlot is registered once for good into a registry in place of
+// the collectors of a metric, and collects the current one. A registry
+// remembers the label names of every metric registered into it even once
+// unregistered, so collectors with other label names could never take the
+// place of the previous ones. The slot describes nothing, so the registry
+// takes it as unchecked.
+type collectorSlot struct {
+	mu sync.RWMutex
+	c  prometheus.Collector
+}
+
+func (s *collectorSlot) get() prometheus.Collector {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c
+}
+
+func (s *collectorSlot) set(c prometheus.Collector) {
+	s.mu.Lock()
+	s.c = c
+	s.mu.Unlock()
+}
+
+func (s *collectorSlot) Describe(chan<- *prometheus.Desc) {}
+
+func (s *collectorSlot) Collect(ch chan<- prometheus.Metric) {
+	if c := s.get(); c != nil {
+		c.Collect(ch)
+	}
+}
+
+// registryOf returns the registry behind reg, the same across instances.
+func registryOf(reg prometheus.Registerer) prometheus.Registerer {
+	if ref, ok := reg.(*registryRef); ok {
+		return ref.Registerer
+	}
+	return reg
+}
+
+// ownedBy tells whether the collector of key is in use by an instance of
+// config. The caller holds registeredCollectors.mu.
+func ownedBy(key collectorKey, config configID) bool {
+	o, ok := registeredCollectors.owners[key]
+	return ok && o.refs[config] > 0
+}
+
+// own records an instance of config using the collector of key, which
+// slot collects. The caller holds registeredCollectors.mu.
+func own(key collectorKey, slot *collectorSlot, config configID) {
+	o, ok := registeredCollectors.owners[key]
+	if !ok {
+		o = &collectorOwners{slot: slot, refs: make(map[configID]int)}
+		registeredCollectors.owners[key] = o
+	}
+	o.refs[config]++
+	slot.set(key.c)
+}
+
+// releaseCollectors drops the uses of the collectors of keys by an instance
+// of config; the ones no longer used stop being collected.
+func releaseCollectors(keys []collectorKey, config configID) {
+	registeredCollectors.mu.Lock()
+	defer registeredCollectors.mu.Unlock()
+
+	for _, key := range keys {
+		o, ok := registeredCollectors.owners[key]
+		if !ok {
+			continue
+		}
+		o.refs[config]--
+		if o.refs[config] <= 0 {
+			delete(o.refs, config)
+		}
+		if len(o.refs) > 0 {
+			continue
+		}
+		delete(registeredCollectors.owners, key)
+		// a collector replaced by a newer one no longer holds its slot
+		if o.slot.get() == key.c {
+			o.slot.set(nil)
+		}
+		forgetBuckets(key.c)
+	}
+}
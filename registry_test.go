@@ -0,0 +1,120 @@
+package extend_metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegisterAfterCleanup(t *testing.T) {
+	old, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_register_cleanup
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Cleanup()
+
+	c, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_register_cleanup
+		has_body_label
+	}`)
+	if err != nil {
+		t.Fatalf("enabling a label once the previous handler is cleaned up: %v", err)
+	}
+	serveTestRequest(c, "GET", "http://example.com/", okHandler)
+	if samples := scrapeTestRegistry(t, "custom:test_register_cleanup"); !strings.Contains(samples, `has_body="false"`) {
+		t.Errorf("expected the has_body label, got:\n%s", samples)
+	}
+}
+
+func TestRegisterReload(t *testing.T) {
+	const spec = "custom:test_register_reload"
+	old, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_register_reload
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestRequest(old, "GET", "http://example.com/", okHandler)
+
+	// the new config is provisioned before the old one is cleaned up
+	c, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_register_reload
+		has_body_label
+	}`)
+	if err != nil {
+		t.Fatalf("enabling a label across a reload: %v", err)
+	}
+	old.Cleanup()
+	serveTestRequest(c, "GET", "http://example.com/", okHandler)
+
+	samples := scrapeTestRegistry(t, spec)
+	if !strings.Contains(samples, `caddy_http_extend_requests_total{host="example.com"} 2`) {
+		t.Errorf("expected the request counter to carry over, got:\n%s", samples)
+	}
+	if !strings.Contains(samples, `has_body="false"`) || strings.Contains(samples, `request_duration_seconds_count{code="200",host="example.com",method="GET"}`) {
+		t.Errorf("expected only the series of the new handler, got:\n%s", samples)
+	}
+}
+
+func TestRegisterSameConfigConflict(t *testing.T) {
+	ctx := newTestContext(t)
+	if _, err := provisionTestHandler(t, ctx, `extend_metrics {
+		registry custom:test_register_conflict
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	_, err := provisionTestHandler(t, ctx, `extend_metrics {
+		registry custom:test_register_conflict
+		has_body_label
+	}`)
+	if err == nil || !strings.Contains(err.Error(), "must enable the same labels") {
+		t.Errorf("expected handlers of one config with different labels to conflict, got %v", err)
+	}
+	if _, err := provisionTestHandler(t, ctx, `extend_metrics {
+		registry custom:test_register_conflict
+	}`); err != nil {
+		t.Errorf("expected handlers of one config with the same labels to share the metrics: %v", err)
+	}
+}
+
+func TestRegisterBucketsChange(t *testing.T) {
+	const spec = "custom:test_register_buckets"
+	old, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_register_buckets
+		duration_buckets 1 2 3
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_register_buckets
+		duration_buckets 10 20
+	}`)
+	if err != nil {
+		t.Fatalf("changing buckets across a reload: %v", err)
+	}
+	old.Cleanup()
+	serveTestRequest(c, "GET", "http://example.com/", okHandler)
+	samples := scrapeTestRegistry(t, spec)
+	if !strings.Contains(samples, `request_duration_seconds_bucket{code="200",host="example.com",method="GET",le="20"}`) || strings.Contains(samples, `le="3"`) {
+		t.Errorf("expected the new buckets, got:\n%s", samples)
+	}
+}
+
+func TestRegisterBucketsConflict(t *testing.T) {
+	ctx := newTestContext(t)
+	if _, err := provisionTestHandler(t, ctx, `extend_metrics {
+		registry custom:test_register_buckets_conflict
+		duration_buckets 1 2 3
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	_, err := provisionTestHandler(t, ctx, `extend_metrics {
+		registry custom:test_register_buckets_conflict
+		duration_buckets 10 20
+	}`)
+	if err == nil || !strings.Contains(err.Error(), "buckets") {
+		t.Errorf("expected handlers of one config with different buckets to conflict, got %v", err)
+	}
+}
@@ -1,10 +1,20 @@
 package extend_metrics
 
 import (
+	"hash/fnv"
 	"net/http"
 	"strconv"
+	"unicode/utf8"
 )
 
+const defaultMaxLabelLength = 512
+
+const otherCode = "other"
+
+// defaultCommonCodes are the codes tracked individually when `common_codes`
+// is given without arguments.
+var defaultCommonCodes = []int{200, 204, 301, 302, 304, 400, 401, 403, 404, 429, 500, 502, 503, 504}
+
 func SanitizeCode(s int) string {
 	switch s {
 	case 0, 200:
@@ -37,3 +47,53 @@ func SanitizeMethod(m string) string {
 
 	return "OTHER"
 }
+
+// TruncateLabelValue shortens label values longer than max bytes. The cut is
+// made on a rune boundary and followed by a hash of the full value, so that
+// distinct long values don't collapse into the same series. When max leaves
+// no room for the value, the hash alone is kept, cut to max bytes. A max of
+// 0 or less disables truncation.
+func TruncateLabelValue(v string, max int) string {
+	if max <= 0 || len(v) <= max {
+		return v
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(v))
+	suffix := "~" + strconv.FormatUint(uint64(h.Sum32()), 16)
+
+	cut := max - len(suffix)
+	if cut <= 0 {
+		return suffix[:max]
+	}
+	for cut > 0 && !utf8.RuneStart(v[cut]) {
+		cut--
+	}
+
+	return v[:cut] + suffix
+}
+
+// MethodClass groups a sanitized method by its semantics: `safe` methods
+// don't modify state, `idempotent` ones may but can be retried, and
+// `unsafe` ones can't be retried blindly.
+func MethodClass(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return "safe"
+	case http.MethodPut, http.MethodDelete:
+		return "idempotent"
+	case http.MethodPost, http.MethodPatch, http.MethodConnect:
+		return "unsafe"
+	default:
+		return "other"
+	}
+}
+
+// SanitizeGRPCStatus bounds a grpc-status value to the codes defined by
+// gRPC, 0 to 16.
+func SanitizeGRPCStatus(s string) string {
+	if code, err := strconv.Atoi(s); err == nil && code >= 0 && code <= 16 {
+		return strconv.Itoa(code)
+	}
+	return otherCode
+}
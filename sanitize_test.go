@@ -0,0 +1,46 @@
+package extend_metrics
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateLabelValue(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	for _, max := range []int{1, 3, 9, 10, 16, 64} {
+		got := TruncateLabelValue(long, max)
+		if len(got) > max {
+			t.Errorf("max %d: expected at most %d bytes, got %q", max, max, got)
+		}
+		if other := TruncateLabelValue(long+"b", max); max >= 9 && other == got {
+			t.Errorf("max %d: expected distinct values to stay distinct, got %q for both", max, got)
+		}
+	}
+
+	if got := TruncateLabelValue(strings.Repeat("é", 20), 16); len(got) > 16 || !utf8.ValidString(got) {
+		t.Errorf("expected a valid UTF-8 value of at most 16 bytes, got %q", got)
+	}
+	if got := TruncateLabelValue("short", 16); got != "short" {
+		t.Errorf("expected a short value as is, got %q", got)
+	}
+	for _, max := range []int{0, -1} {
+		if got := TruncateLabelValue(long, max); got != long {
+			t.Errorf("max %d: expected truncation to be disabled, got %q", max, got)
+		}
+	}
+}
+
+func TestMaxLabelLengthDisabled(t *testing.T) {
+	c, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_max_label_length_disabled
+		max_label_length 0
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", 2*defaultMaxLabelLength)
+	if got := c.labelValue(long); got != long {
+		t.Errorf("expected max_label_length 0 to disable truncation, got %d bytes", len(got))
+	}
+}
@@ -0,0 +1,236 @@
+package extend_metrics
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStatsDPrefix        = "caddy.http_extend"
+	defaultStatsDFlushInterval = time.Second
+	// 1432 bytes keeps a datagram inside a typical 1500 MTU once the IP and
+	// UDP headers are accounted for.
+	defaultStatsDMaxPacketSize = 1432
+	statsDQueueSize            = 4096
+)
+
+// StatsD configures an optional sink sending the observations over UDP in
+// StatsD or DogStatsD format.
+type StatsD struct {
+	// The `host:port` of the StatsD daemon.
+	Address string `json:"address,omitempty"`
+
+	// Either `statsd` (labels are folded into the metric name) or
+	// `dogstatsd` (labels are sent as tags). Default: `statsd`.
+	Format string `json:"format,omitempty"`
+
+	// Prefix of every metric name. Default: `caddy.http_extend`.
+	Prefix string `json:"prefix,omitempty"`
+
+	// How often buffered metrics are sent. Default: 1s.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// Maximum size of a single datagram. Default: 1432.
+	MaxPacketSize int `json:"max_packet_size,omitempty"`
+}
+
+// statsdClient batches metric lines into datagrams. Lines are queued without
+// blocking; if the queue is full the line is dropped so that a slow or
+// missing daemon never affects request serving.
+type statsdClient struct {
+	conn      net.Conn
+	dogstatsd bool
+	prefix    string
+	maxPacket int
+	interval  time.Duration
+	logger    *zap.Logger
+
+	lines chan string
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newStatsDClient(cfg *StatsD, logger *zap.Logger) (*statsdClient, error) {
+	switch cfg.Format {
+	case "", "statsd", "dogstatsd":
+	default:
+		return nil, fmt.Errorf("unrecognized statsd format: %s", cfg.Format)
+	}
+
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("dialing statsd address %s: %v", cfg.Address, err)
+	}
+
+	c := &statsdClient{
+		conn:      conn,
+		dogstatsd: cfg.Format == "dogstatsd",
+		prefix:    cfg.Prefix,
+		maxPacket: cfg.MaxPacketSize,
+		interval:  time.Duration(cfg.FlushInterval),
+		logger:    logger,
+		lines:     make(chan string, statsDQueueSize),
+		done:      make(chan struct{}),
+	}
+	if c.prefix == "" {
+		c.prefix = defaultStatsDPrefix
+	}
+	if c.maxPacket <= 0 {
+		c.maxPacket = defaultStatsDMaxPacketSize
+	}
+	if c.interval <= 0 {
+		c.interval = defaultStatsDFlushInterval
+	}
+
+	c.wg.Add(1)
+	go c.loop()
+
+	return c, nil
+}
+
+func (c *statsdClient) loop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	buf := make([]byte, 0, c.maxPacket)
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		if _, err := c.conn.Write(buf); err != nil {
+			c.logger.Debug("failed to send statsd packet", zap.Error(err))
+		}
+		buf = buf[:0]
+	}
+	add := func(line string) {
+		if len(buf) > 0 && len(buf)+1+len(line) > c.maxPacket {
+			flush()
+		}
+		if len(buf) > 0 {
+			buf = append(buf, '\n')
+		}
+		buf = append(buf, line...)
+	}
+
+	for {
+		select {
+		case line := <-c.lines:
+			add(line)
+		case <-ticker.C:
+			flush()
+		case <-c.done:
+			for {
+				select {
+				case line := <-c.lines:
+					add(line)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *statsdClient) close() error {
+	close(c.done)
+	c.wg.Wait()
+	return c.conn.Close()
+}
+
+func (c *statsdClient) send(name, value, typ string, tags [][2]string) {
+	var sb strings.Builder
+	sb.WriteString(c.prefix)
+	sb.WriteByte('.')
+	sb.WriteString(name)
+	if !c.dogstatsd {
+		for _, tag := range tags {
+			sb.WriteByte('.')
+			sb.WriteString(statsdNameSegment(tag[1]))
+		}
+	}
+	sb.WriteByte(':')
+	sb.WriteString(value)
+	sb.WriteByte('|')
+	sb.WriteString(typ)
+	if c.dogstatsd && len(tags) > 0 {
+		sb.WriteString("|#")
+		for i, tag := range tags {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(tag[0])
+			sb.WriteByte(':')
+			sb.WriteString(statsdTagValue(tag[1]))
+		}
+	}
+
+	select {
+	case c.lines <- sb.String():
+	default:
+	}
+}
+
+func (c *statsdClient) count(name string, tags [][2]string) {
+	c.send(name, "1", "c", tags)
+}
+
+func (c *statsdClient) timing(name string, d float64, tags [][2]string) {
+	c.send(name, strconv.FormatFloat(d*1000, 'f', -1, 64), "ms", tags)
+}
+
+func (c *statsdClient) histogram(name string, v float64, tags [][2]string) {
+	typ := "ms"
+	if c.dogstatsd {
+		typ = "h"
+	}
+	c.send(name, strconv.FormatFloat(v, 'f', -1, 64), typ, tags)
+}
+
+// statsdNameSegment makes a label value safe to use as one dot-separated
+// segment of a plain StatsD metric name.
+func statsdNameSegment(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ',', '/', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// statsdTagValue strips the characters DogStatsD uses as separators.
+func statsdTagValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '|', ',', '#', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// statsdTags converts Prometheus labels into StatsD tags, sorted by name so
+// that plain StatsD metric names are stable.
+func statsdTags(labels prometheus.Labels) [][2]string {
+	tags := make([][2]string, 0, len(labels))
+	for name, value := range labels {
+		tags = append(tags, [2]string{name, value})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i][0] < tags[j][0] })
+	return tags
+}
@@ -0,0 +1,96 @@
+package extend_metrics
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// statsdTestDatagrams sends through a client of cfg and returns the
+// datagrams received once it is closed.
+func statsdTestDatagrams(t *testing.T, cfg *StatsD, send func(c *statsdClient)) []string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cfg.Address = conn.LocalAddr().String()
+	// only the size limit and close flush during the test
+	cfg.FlushInterval = caddy.Duration(time.Hour)
+	c, err := newStatsDClient(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(c)
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var datagrams []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		datagrams = append(datagrams, string(buf[:n]))
+	}
+	return datagrams
+}
+
+func TestStatsDBatching(t *testing.T) {
+	const line = "caddy.http_extend.requests.200.a_example_com:1|c"
+	got := statsdTestDatagrams(t, &StatsD{MaxPacketSize: 2*len(line) + 1}, func(c *statsdClient) {
+		for i := 0; i < 5; i++ {
+			c.count("requests", statsdTags(map[string]string{"host": "a.example.com", "code": "200"}))
+		}
+	})
+	want := []string{line + "\n" + line, line + "\n" + line, line}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected datagrams %q, got %q", want, got)
+	}
+	for _, datagram := range got {
+		if len(datagram) > 2*len(line)+1 {
+			t.Errorf("expected datagrams of at most %d bytes, got %d", 2*len(line)+1, len(datagram))
+		}
+	}
+}
+
+func TestStatsDFormats(t *testing.T) {
+	tags := statsdTags(map[string]string{"host": "a.example.com", "code": "200", "path": "/a b,c|d", "service": ""})
+	for _, tt := range []struct {
+		format string
+		want   []string
+	}{
+		{
+			format: "statsd",
+			want: []string{
+				"app.request_duration.200.a_example_com._a_b_c_d.none:250|ms",
+				"app.response_size.200.a_example_com._a_b_c_d.none:512|ms",
+			},
+		},
+		{
+			format: "dogstatsd",
+			want: []string{
+				"app.request_duration:250|ms|#code:200,host:a.example.com,path:/a b_c_d,service:",
+				"app.response_size:512|h|#code:200,host:a.example.com,path:/a b_c_d,service:",
+			},
+		},
+	} {
+		got := statsdTestDatagrams(t, &StatsD{Format: tt.format, Prefix: "app"}, func(c *statsdClient) {
+			c.timing("request_duration", 0.25, tags)
+			c.histogram("response_size", 512, tags)
+		})
+		want := []string{tt.want[0] + "\n" + tt.want[1]}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: expected datagrams %q, got %q", tt.format, want, got)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package extend_metrics
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/yoshino-s/caddy-metrics"
+
+// newTracer returns the tracer of the spans around the handler chain. It
+// comes from the global OpenTelemetry provider, a no-op one unless a
+// provider was installed: Caddy's tracing handler keeps its own to itself.
+func newTracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startSpan starts the span of r, named by its method and normalized path,
+// unless it already belongs to a trace. The span is nil when it isn't
+// recorded, in which case r is returned as is.
+func (c *CaddyMetrics) startSpan(r *http.Request) (*http.Request, trace.Span) {
+	if c.tracer == nil || trace.SpanContextFromContext(r.Context()).IsValid() {
+		return r, nil
+	}
+	name := r.Method + " " + truncatePath(r.URL.Path, defaultPathLabelDepth)
+	ctx, span := c.tracer.Start(r.Context(), name, trace.WithSpanKind(trace.SpanKindServer))
+	if !span.IsRecording() {
+		return r, nil
+	}
+	return r.WithContext(ctx), span
+}
+
+// panicError returns the error recorded on the span of a request whose
+// handler chain panicked with v.
+func panicError(v any) error {
+	if err, ok := v.(error); ok {
+		return err
+	}
+	return fmt.Errorf("panic: %v", v)
+}
+
+// endSpan ends span with the labels of the request as attributes, marking
+// it failed on a handler error or a 5xx.
+func (c *CaddyMetrics) endSpan(span trace.Span, labels map[string]string, err error) {
+	attrs := make([]attribute.KeyValue, 0, len(labels))
+	for name, value := range labels {
+		attrs = append(attrs, attribute.String(name, value))
+	}
+	span.SetAttributes(attrs...)
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case strings.HasPrefix(labels[c.codeKey], "5"):
+		span.SetStatus(codes.Error, "")
+	}
+	span.End()
+}
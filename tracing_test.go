@@ -0,0 +1,104 @@
+package extend_metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// testSpan records how a span was ended.
+type testSpan struct {
+	noop.Span
+	err    error
+	status codes.Code
+	ended  bool
+}
+
+func (s *testSpan) IsRecording() bool                             { return true }
+func (s *testSpan) RecordError(err error, _ ...trace.EventOption) { s.err = err }
+func (s *testSpan) SetStatus(code codes.Code, _ string)           { s.status = code }
+func (s *testSpan) End(...trace.SpanEndOption)                    { s.ended = true }
+
+type testTracer struct {
+	noop.Tracer
+	span *testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, _ string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.span = new(testSpan)
+	return trace.ContextWithSpan(ctx, t.span), t.span
+}
+
+func TestSpanEnded(t *testing.T) {
+	c, err := provisionTestHandler(t, newTestContext(t), `extend_metrics {
+		registry custom:test_span_ended
+		tracing
+		aborts
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := new(testTracer)
+	c.tracer = tracer
+
+	upstreamErr := caddyhttp.Error(http.StatusBadGateway, errors.New("upstream down"))
+	for _, tt := range []struct {
+		name   string
+		next   caddyhttp.Handler
+		err    error
+		status codes.Code
+	}{
+		{name: "ok", next: okHandler, status: codes.Unset},
+		{
+			name: "error",
+			next: caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return upstreamErr
+			}),
+			err:    upstreamErr,
+			status: codes.Error,
+		},
+		{
+			name: "panic",
+			next: caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				panic("boom")
+			}),
+			err:    errors.New("panic: boom"),
+			status: codes.Error,
+		},
+		{
+			name: "abort",
+			next: caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				panic(http.ErrAbortHandler)
+			}),
+			err:    http.ErrAbortHandler,
+			status: codes.Error,
+		},
+	} {
+		func() {
+			defer func() { recover() }()
+			serveTestRequest(c, "GET", "http://example.com/"+tt.name, tt.next)
+		}()
+		span := tracer.span
+		if span == nil || !span.ended {
+			t.Errorf("%s: expected the span to be ended", tt.name)
+			continue
+		}
+		if fmtErr(span.err) != fmtErr(tt.err) || span.status != tt.status {
+			t.Errorf("%s: expected error %v and status %v, got %v and %v", tt.name, tt.err, tt.status, span.err, span.status)
+		}
+		tracer.span = nil
+	}
+}
+
+func fmtErr(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
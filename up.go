@@ -0,0 +1,143 @@
+package extend_metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultHandlerUpName = "default"
+
+// liveSeries counts the provisioned instances behind each series reported
+// only while an instance is, such as handler_up. During a config reload the
+// new instances are provisioned before the old ones are cleaned up, so a
+// series is only deleted once the last instance reporting it is gone.
+var liveSeries = struct {
+	mu     sync.Mutex
+	counts map[liveSeriesKey]int
+}{
+	counts: make(map[liveSeriesKey]int),
+}
+
+type liveSeriesKey struct {
+	gauge  *prometheus.GaugeVec
+	labels string
+}
+
+// markLive sets the series of gauge with labels to 1 and returns a func to
+// call once the instance is cleaned up.
+func markLive(gauge *prometheus.GaugeVec, labels prometheus.Labels) func() {
+	return markLiveValue(gauge, labels, 1)
+}
+
+// markLiveValue is markLive for a series holding value. When the instances
+// sharing the series disagree, the one marking it last sets the value.
+func markLiveValue(gauge *prometheus.GaugeVec, labels prometheus.Labels, value float64) func() {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(labels[name])
+		sb.WriteByte(0)
+	}
+	key := liveSeriesKey{gauge: gauge, labels: sb.String()}
+
+	liveSeries.mu.Lock()
+	liveSeries.counts[key]++
+	gauge.With(labels).Set(value)
+	liveSeries.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			liveSeries.mu.Lock()
+			defer liveSeries.mu.Unlock()
+
+			liveSeries.counts[key]--
+			if liveSeries.counts[key] <= 0 {
+				delete(liveSeries.counts, key)
+				gauge.Delete(labels)
+			}
+		})
+	}
+}
+
+// liveHostSeries marks a series of a gauge holding value live per host, the
+// first time the instance sees the host, until the instance is cleaned up.
+type liveHostSeries struct {
+	gauge   *prometheus.GaugeVec
+	hostKey string
+	value   float64
+
+	mu    sync.Mutex
+	downs map[string]func()
+	hosts sync.Map // host -> struct{}, the hosts marked so far
+}
+
+func newLiveHostSeries(gauge *prometheus.GaugeVec, hostKey string, value float64) *liveHostSeries {
+	return &liveHostSeries{
+		gauge:   gauge,
+		hostKey: hostKey,
+		value:   value,
+		downs:   make(map[string]func()),
+	}
+}
+
+func (s *liveHostSeries) mark(host string) {
+	if _, ok := s.hosts.Load(host); ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.downs == nil {
+		return
+	}
+	if _, ok := s.downs[host]; !ok {
+		s.downs[host] = markLiveValue(s.gauge, prometheus.Labels{s.hostKey: host}, s.value)
+		s.hosts.Store(host, struct{}{})
+	}
+}
+
+// down unmarks the series marked by the instance.
+func (s *liveHostSeries) down() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, down := range s.downs {
+		down()
+	}
+	s.downs = nil
+}
+
+// handlerUpLabels returns the labels of the handler_up series of name.
+func handlerUpLabels(name string) prometheus.Labels {
+	version, _ := caddy.Version()
+	return prometheus.Labels{"name": name, "caddy_version": version}
+}
+
+// markHandlerUp sets the handler_up series of name to 1 and returns a func
+// to call once the instance is cleaned up.
+func markHandlerUp(gauge *prometheus.GaugeVec, name string) func() {
+	return markLive(gauge, handlerUpLabels(name))
+}
+
+// configHash returns a short hash of the JSON config of c. It must be taken
+// before provisioning, which consumes the raw module configs.
+func configHash(c *CaddyMetrics) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:6]), nil
+}